@@ -0,0 +1,287 @@
+package mstatus
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArtworkFetcher is implemented by plugins able to provide the cover art for
+// a track themselves, such as from the player or the file's tags. It
+// returns nil data if there is none.
+type ArtworkFetcher interface {
+	FetchArtwork(*Track) ([]byte, error)
+}
+
+const (
+	coverArtArchiveURL = "https://coverartarchive.org"
+	// maxArtworkSize limits downloaded images
+	maxArtworkSize = 10 << 20
+	// artworkRetry is how long to wait before looking for missing art again
+	artworkRetry = time.Hour
+	// artworkQueueSize limits fetches waiting for the worker, more are
+	// queued on a later status
+	artworkQueueSize = 16
+)
+
+// Artwork resolves cover art for tracks and caches the images on disk,
+// keyed by release. Art is fetched in the background so statuses are
+// never held up by a slow server.
+type Artwork struct {
+	dir        string
+	fetchers   []ArtworkFetcher
+	httpClient *http.Client
+	caaURL     string
+	log        Logger
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	queue     chan Track
+	done      chan struct{}
+	// Fetches queued or running, those queued at Stop are dropped
+	pending sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool
+	// paths holds the files found or saved for each key
+	paths    map[string]string
+	missing  map[string]time.Time
+	inflight map[string]bool
+}
+
+// NewArtwork creates an artwork cache in dir, trying each fetcher before
+// falling back to the track's artwork URL and the Cover Art Archive.
+func NewArtwork(dir string, log Logger, fetchers ...ArtworkFetcher) *Artwork {
+	if log == nil {
+		log = func(...any) {}
+	}
+	return &Artwork{
+		dir:        dir,
+		fetchers:   fetchers,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		caaURL:     coverArtArchiveURL,
+		log:        log,
+		paths:      make(map[string]string),
+		missing:    make(map[string]time.Time),
+		inflight:   make(map[string]bool),
+	}
+}
+
+// Path returns the local path of the cover art for t if it has been
+// cached. Otherwise it is fetched in the background for a later status and
+// an empty path is returned.
+func (a *Artwork) Path(t *Track) string {
+	key := artworkKey(t)
+	if key == "" {
+		return ""
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if p, ok := a.paths[key]; ok {
+		return p
+	}
+	// Failed lookups are not retried on every status
+	if at, ok := a.missing[key]; ok && time.Since(at) < artworkRetry {
+		return ""
+	}
+	if a.inflight[key] || a.stopped {
+		return ""
+	}
+	if p := a.cached(key); p != "" {
+		a.paths[key] = p
+		return p
+	}
+
+	a.startOnce.Do(a.start)
+	select {
+	case a.queue <- *t:
+		a.inflight[key] = true
+		a.pending.Add(1)
+	default:
+	}
+	return ""
+}
+
+// Stop ends the background fetches.
+func (a *Artwork) Stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	if a.done != nil {
+		a.stopOnce.Do(func() { close(a.done) })
+	}
+}
+
+func (a *Artwork) start() {
+	a.queue = make(chan Track, artworkQueueSize)
+	a.done = make(chan struct{})
+	go a.run()
+}
+
+// run fetches queued art until stopped.
+func (a *Artwork) run() {
+	for {
+		select {
+		case <-a.done:
+			// Nothing is queued once stopped, drop what remains
+			for {
+				select {
+				case <-a.queue:
+					a.pending.Done()
+				default:
+					return
+				}
+			}
+		case t := <-a.queue:
+			a.resolve(&t)
+			a.pending.Done()
+		}
+	}
+}
+
+// resolve fetches and saves the art for t, recording it as missing on
+// failure.
+func (a *Artwork) resolve(t *Track) {
+	key := artworkKey(t)
+	p, err := a.fetchAndSave(key, t)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.inflight, key)
+	if err != nil {
+		a.log("failed to fetch artwork", t, err)
+	}
+	if p == "" {
+		a.missing[key] = time.Now()
+		return
+	}
+	delete(a.missing, key)
+	a.paths[key] = p
+}
+
+func (a *Artwork) fetchAndSave(key string, t *Track) (string, error) {
+	data, err := a.fetch(t)
+	if err != nil || len(data) == 0 {
+		return "", err
+	}
+	return a.save(key, data)
+}
+
+// artworkKey identifies the release of t, preferring the MusicBrainz ID.
+func artworkKey(t *Track) string {
+	if t.MbReleaseID != "" {
+		return "mbid-" + t.MbReleaseID
+	}
+	if t.Album == "" {
+		return ""
+	}
+	artist := t.AlbumArtist
+	if artist == "" {
+		artist = t.Artist
+	}
+	sum := sha1.Sum([]byte(strings.ToLower(artist + "\x1f" + t.Album)))
+	return "album-" + hex.EncodeToString(sum[:])
+}
+
+// cached returns a file saved for key by an earlier run.
+func (a *Artwork) cached(key string) string {
+	matches, _ := filepath.Glob(path.Join(a.dir, key+".*"))
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			return m
+		}
+	}
+	return ""
+}
+
+func (a *Artwork) fetch(t *Track) ([]byte, error) {
+	for _, f := range a.fetchers {
+		data, err := f.FetchArtwork(t)
+		if err != nil {
+			a.log("failed to fetch artwork", t, err)
+			continue
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+	if t.ArtworkURL != "" {
+		data, err := a.download(t.ArtworkURL)
+		if err != nil {
+			a.log("failed to download artwork", t.ArtworkURL, err)
+		}
+		if len(data) > 0 {
+			return data, nil
+		}
+	}
+	if t.MbReleaseID != "" {
+		data, err := a.download(a.caaURL + "/release/" + t.MbReleaseID + "/front-500")
+		if err != nil && !errors.Is(err, errArtworkNotFound) {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, nil
+}
+
+var errArtworkNotFound = errors.New("artwork not found")
+
+func (a *Artwork) download(uri string) ([]byte, error) {
+	resp, err := a.httpClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errArtworkNotFound
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("artwork request failed: %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxArtworkSize))
+}
+
+func (a *Artwork) save(key string, data []byte) (string, error) {
+	var ext string
+	switch http.DetectContentType(data) {
+	case "image/png":
+		ext = ".png"
+	case "image/gif":
+		ext = ".gif"
+	case "image/webp":
+		ext = ".webp"
+	default:
+		ext = ".jpg"
+	}
+	p := path.Join(a.dir, key+ext)
+	if err := WriteFileAtomic(p, data, 0644); err != nil {
+		return "", err
+	}
+	a.log("cached artwork", p)
+	return p, nil
+}
+
+// WriteFileAtomic writes data to a temporary file and renames it over name
+// so readers never see a partial file.
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
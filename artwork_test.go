@@ -0,0 +1,137 @@
+package mstatus
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+var pngData = []byte("\x89PNG\r\n\x1a\n0000")
+
+type fakeFetcher struct {
+	data []byte
+	// wait blocks fetches until closed, if set
+	wait chan struct{}
+}
+
+func (f *fakeFetcher) FetchArtwork(*Track) ([]byte, error) {
+	if f.wait != nil {
+		<-f.wait
+	}
+	return f.data, nil
+}
+
+func TestArtworkPath(t *testing.T) {
+	tests := map[string]struct {
+		track   Track
+		fetcher []byte
+		want    string
+		// Expected requests to the remote server
+		requests int
+	}{
+		"no album": {
+			track: Track{Title: "title"},
+		},
+		"fetcher": {
+			track:   Track{Album: "album", Artist: "artist"},
+			fetcher: pngData,
+			want:    "album-",
+		},
+		"artwork url": {
+			track:    Track{Album: "album", Artist: "artist", ArtworkURL: "/image"},
+			want:     "album-",
+			requests: 1,
+		},
+		"cover art archive": {
+			track:    Track{Album: "album", MbReleaseID: "release"},
+			want:     "mbid-release.png",
+			requests: 1,
+		},
+		"missing": {
+			track:    Track{Album: "album", MbReleaseID: "missing"},
+			requests: 1,
+		},
+		"server error": {
+			track:    Track{Album: "album", MbReleaseID: "error"},
+			requests: 1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var requests int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				switch r.URL.Path {
+				case "/image", "/release/release/front-500":
+					w.Write(pngData)
+				case "/release/error/front-500":
+					w.WriteHeader(http.StatusBadGateway)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+
+			f := &fakeFetcher{data: tt.fetcher}
+			a := NewArtwork(t.TempDir(), Logger(t.Log), f)
+			defer a.Stop()
+			a.httpClient = ts.Client()
+			a.caaURL = ts.URL
+			if tt.track.ArtworkURL != "" {
+				tt.track.ArtworkURL = ts.URL + tt.track.ArtworkURL
+			}
+
+			// Fetched in the background for later calls, which are
+			// served from the cache
+			if got := a.Path(&tt.track); got != "" {
+				t.Fatalf("got %q before fetching", got)
+			}
+			a.pending.Wait()
+			for i := 0; i < 2; i++ {
+				got := a.Path(&tt.track)
+				if tt.want == "" {
+					if got != "" {
+						t.Fatalf("got %q, want none", got)
+					}
+					continue
+				}
+				if !bytes.HasPrefix([]byte(path.Base(got)), []byte(tt.want)) {
+					t.Fatalf("got %q, want %q", got, tt.want)
+				}
+				b, err := os.ReadFile(got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(b, pngData) {
+					t.Fatalf("got %q, want %q", b, pngData)
+				}
+			}
+			if requests != tt.requests {
+				t.Errorf("got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestArtworkBackground(t *testing.T) {
+	f := &fakeFetcher{data: pngData, wait: make(chan struct{})}
+	a := NewArtwork(t.TempDir(), Logger(t.Log), f)
+	defer a.Stop()
+
+	// A slow fetch does not hold up statuses
+	track := &Track{Album: "album", Artist: "artist"}
+	for i := 0; i < 3; i++ {
+		if got := a.Path(track); got != "" {
+			t.Fatalf("got %q before fetching", got)
+		}
+	}
+	close(f.wait)
+	a.pending.Wait()
+	if got := a.Path(track); got == "" {
+		t.Error("art not cached after fetching")
+	}
+}
@@ -0,0 +1,199 @@
+package mstatus
+
+import (
+	"errors"
+	"text/template"
+	"time"
+)
+
+// ChatStatus is implemented by handlers that publish the current track as a
+// user status on a chat service.
+type ChatStatus interface {
+	// SetStatus publishes text, expiring at expires unless it is zero
+	SetStatus(text string, expires time.Time) error
+	// ResetStatus restores the default status
+	ResetStatus() error
+}
+
+// ChatStatusRefresher is implemented by a ChatStatus whose track status
+// depends on more than the track, such as the user's availability. The
+// runner calls RefreshStatus every Interval while a track status is set.
+type ChatStatusRefresher interface {
+	RefreshStatus() error
+}
+
+// ChatStatusRunner drives a ChatStatus from a stream of statuses. The
+// default status is restored when playback stops, pauses or fails. Failed
+// updates are retried if the error implements RetryAfter.
+type ChatStatusRunner struct {
+	// Expiry after the track finishes, zero for none
+	Expiry time.Duration
+	// Expires overrides when a track status expires, for services keeping
+	// their own rule. The zero time is no expiry.
+	Expires func(*Track) time.Time
+	// Interval is the minimum time between updates, changes within it are
+	// coalesced
+	Interval time.Duration
+	// ExpireLocally resets the status on expiry, for services that cannot
+	// expire a status themselves
+	ExpireLocally bool
+	// Template formats the status, defaults to the track string
+	Template *template.Template
+	// Errorf reports failures, in the style of the plugin's errorf
+	Errorf func(format string, v ...interface{})
+}
+
+// StatusExpiry returns when a status for t should expire, extra after the
+// track finishes. It returns the zero time if extra is not positive.
+func StatusExpiry(t *Track, extra time.Duration) time.Time {
+	if extra <= 0 || t == nil {
+		return time.Time{}
+	}
+	remaining := t.Duration - t.Elapsed
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Now().Add(remaining + extra)
+}
+
+// RetryAfter is implemented by errors from a ChatStatus that should be
+// retried after a delay, such as rate limiting.
+type RetryAfter interface {
+	RetryAfter() time.Duration
+}
+
+// Run publishes events to c until events is closed.
+func (r ChatStatusRunner) Run(events <-chan Status, c ChatStatus) {
+	var (
+		// Desired status, empty for the default
+		current string
+		expires time.Time
+		// Whether current has yet to be published
+		pending bool
+		// Earliest time of the next update
+		next   time.Time
+		wake   *time.Timer
+		expire *time.Timer
+	)
+	defer func() {
+		if wake != nil {
+			wake.Stop()
+		}
+		if expire != nil {
+			expire.Stop()
+		}
+	}()
+
+	refresher, _ := c.(ChatStatusRefresher)
+	var refreshC <-chan time.Time
+	if refresher != nil && r.Interval > 0 {
+		refresh := time.NewTicker(r.Interval)
+		defer refresh.Stop()
+		refreshC = refresh.C
+	}
+
+	for {
+		var wakeC, expireC <-chan time.Time
+		if wake != nil {
+			wakeC = wake.C
+		}
+		if expire != nil {
+			expireC = expire.C
+		}
+
+		select {
+		case <-expireC:
+			expire = nil
+			current, pending = "", true
+
+		case <-wakeC:
+			wake = nil
+
+		case <-refreshC:
+			if current == "" || pending {
+				continue
+			}
+			if err := refresher.RefreshStatus(); err != nil {
+				r.errorf("failed to refresh status: %s\n", err)
+			}
+			continue
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			var text string
+			if event.State == StatePlaying && event.Track != nil {
+				var err error
+				if text, err = r.format(event); err != nil {
+					r.errorf("failed to format: %s\n", err)
+					continue
+				}
+			}
+			if text == current {
+				continue
+			}
+			current, pending = text, true
+
+			if expire != nil {
+				expire.Stop()
+				expire = nil
+			}
+			expires = time.Time{}
+			if text != "" {
+				expires = r.expires(event.Track)
+				if r.ExpireLocally && !expires.IsZero() {
+					expire = time.NewTimer(time.Until(expires))
+				}
+			}
+		}
+
+		// Rapid changes are coalesced into one update per interval
+		if !pending || wake != nil {
+			continue
+		}
+		if d := time.Until(next); d > 0 {
+			wake = time.NewTimer(d)
+			continue
+		}
+		var err error
+		if current == "" {
+			if err = c.ResetStatus(); err != nil {
+				r.errorf("failed to reset status: %s\n", err)
+			}
+		} else if err = c.SetStatus(current, expires); err != nil {
+			r.errorf("failed to set status: %s\n", err)
+		}
+		pending = false
+		next = time.Now().Add(r.Interval)
+
+		var ra RetryAfter
+		if errors.As(err, &ra) {
+			pending = true
+			if d := ra.RetryAfter(); time.Until(next) < d {
+				next = time.Now().Add(d)
+			}
+			wake = time.NewTimer(time.Until(next))
+		}
+	}
+}
+
+func (r ChatStatusRunner) expires(t *Track) time.Time {
+	if r.Expires != nil {
+		return r.Expires(t)
+	}
+	return StatusExpiry(t, r.Expiry)
+}
+
+func (r ChatStatusRunner) format(s Status) (string, error) {
+	if r.Template == nil {
+		return s.Track.String(), nil
+	}
+	return ExecuteTemplate(r.Template, s)
+}
+
+func (r ChatStatusRunner) errorf(format string, v ...interface{}) {
+	if r.Errorf != nil {
+		r.Errorf(format, v...)
+	}
+}
@@ -0,0 +1,217 @@
+package mstatus
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeChat struct {
+	sync.Mutex
+	calls []string
+}
+
+func (f *fakeChat) SetStatus(text string, expires time.Time) error {
+	f.Lock()
+	defer f.Unlock()
+	if !expires.IsZero() {
+		text += " (expires)"
+	}
+	f.calls = append(f.calls, text)
+	return nil
+}
+
+func (f *fakeChat) ResetStatus() error {
+	f.Lock()
+	defer f.Unlock()
+	f.calls = append(f.calls, "reset")
+	return nil
+}
+
+func TestChatStatusRunner(t *testing.T) {
+	track := &Track{Title: "title", Artist: "artist", Duration: time.Minute}
+	tests := map[string]struct {
+		runner   ChatStatusRunner
+		statuses []Status
+		wait     time.Duration
+		expected []string
+	}{
+		"stopped": {
+			statuses: []Status{{State: StateStopped}},
+		},
+		"repeated": {
+			statuses: []Status{
+				{State: StatePlaying, Track: track},
+				{State: StatePlaying, Track: track},
+			},
+			expected: []string{`"title" by artist`},
+		},
+		"paused": {
+			statuses: []Status{
+				{State: StatePlaying, Track: track},
+				{State: StatePaused, Track: track},
+				{State: StatePaused, Track: track},
+				{State: StatePlaying, Track: track},
+			},
+			expected: []string{`"title" by artist`, "reset", `"title" by artist`},
+		},
+		"expiry": {
+			runner: ChatStatusRunner{Expiry: time.Hour},
+			statuses: []Status{
+				{State: StatePlaying, Track: track},
+			},
+			expected: []string{`"title" by artist (expires)`},
+		},
+		"local expiry": {
+			runner: ChatStatusRunner{Expiry: 10 * time.Millisecond, ExpireLocally: true},
+			statuses: []Status{
+				{State: StatePlaying, Track: &Track{Title: "short"}},
+			},
+			wait:     100 * time.Millisecond,
+			expected: []string{`"short" (expires)`, "reset"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := &fakeChat{}
+			ch := make(chan Status)
+			done := make(chan struct{})
+			go func() {
+				tt.runner.Run(ch, f)
+				close(done)
+			}()
+			for _, s := range tt.statuses {
+				ch <- s
+			}
+			time.Sleep(tt.wait)
+			close(ch)
+			<-done
+
+			if len(f.calls) != len(tt.expected) {
+				t.Fatalf("got %q, want %q", f.calls, tt.expected)
+			}
+			for i := range tt.expected {
+				if f.calls[i] != tt.expected[i] {
+					t.Errorf("got %q, want %q", f.calls[i], tt.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStatusExpiry(t *testing.T) {
+	if got := StatusExpiry(&Track{Duration: time.Minute}, 0); !got.IsZero() {
+		t.Errorf("got %s, want zero", got)
+	}
+	got := time.Until(StatusExpiry(&Track{Duration: 3 * time.Minute, Elapsed: time.Minute}, time.Minute))
+	if got < 179*time.Second || got > 3*time.Minute {
+		t.Errorf("got %s, want 3m", got)
+	}
+	// Elapsed past the duration
+	got = time.Until(StatusExpiry(&Track{Elapsed: time.Minute}, time.Minute))
+	if got < 59*time.Second || got > time.Minute {
+		t.Errorf("got %s, want 1m", got)
+	}
+}
+
+type retryError time.Duration
+
+func (e retryError) Error() string             { return "rate limited" }
+func (e retryError) RetryAfter() time.Duration { return time.Duration(e) }
+
+// limitedChat fails the first update with a retryError.
+type limitedChat struct {
+	fakeChat
+	failed bool
+}
+
+func (f *limitedChat) SetStatus(text string, expires time.Time) error {
+	f.Lock()
+	failed := f.failed
+	f.failed = true
+	f.Unlock()
+	if !failed {
+		return retryError(20 * time.Millisecond)
+	}
+	return f.fakeChat.SetStatus(text, expires)
+}
+
+func TestChatStatusRunnerCoalesce(t *testing.T) {
+	f := &fakeChat{}
+	ch := make(chan Status)
+	done := make(chan struct{})
+	go func() {
+		ChatStatusRunner{Interval: 50 * time.Millisecond}.Run(ch, f)
+		close(done)
+	}()
+	for _, title := range []string{"one", "two", "three", "four"} {
+		ch <- Status{State: StatePlaying, Track: &Track{Title: title}}
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(ch)
+	<-done
+
+	expected := []string{`"one"`, `"four"`}
+	if len(f.calls) != len(expected) || f.calls[0] != expected[0] || f.calls[1] != expected[1] {
+		t.Errorf("got %q, want %q", f.calls, expected)
+	}
+}
+
+func TestChatStatusRunnerRetry(t *testing.T) {
+	f := &limitedChat{}
+	ch := make(chan Status)
+	done := make(chan struct{})
+	go func() {
+		ChatStatusRunner{}.Run(ch, f)
+		close(done)
+	}()
+	ch <- Status{State: StatePlaying, Track: &Track{Title: "title"}}
+	time.Sleep(100 * time.Millisecond)
+	close(ch)
+	<-done
+
+	if len(f.calls) != 1 || f.calls[0] != `"title"` {
+		t.Errorf("got %q, want retried status", f.calls)
+	}
+}
+
+// refreshChat counts refreshes.
+type refreshChat struct {
+	fakeChat
+	refreshes int
+}
+
+func (f *refreshChat) RefreshStatus() error {
+	f.Lock()
+	defer f.Unlock()
+	f.refreshes++
+	return nil
+}
+
+func TestChatStatusRunnerRefresh(t *testing.T) {
+	f := &refreshChat{}
+	ch := make(chan Status)
+	done := make(chan struct{})
+	go func() {
+		ChatStatusRunner{Interval: 10 * time.Millisecond}.Run(ch, f)
+		close(done)
+	}()
+
+	// Only refreshed while a track status is set
+	time.Sleep(50 * time.Millisecond)
+	f.Lock()
+	if f.refreshes != 0 {
+		t.Errorf("got %d refreshes before playing", f.refreshes)
+	}
+	f.Unlock()
+
+	ch <- Status{State: StatePlaying, Track: &Track{Title: "title"}}
+	time.Sleep(100 * time.Millisecond)
+	close(ch)
+	<-done
+
+	if f.refreshes < 2 {
+		t.Errorf("got %d refreshes, want several", f.refreshes)
+	}
+}
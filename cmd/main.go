@@ -7,11 +7,28 @@ import (
 	"os/signal"
 
 	"src.userspace.com.au/felix/mstatus"
+	_ "src.userspace.com.au/felix/mstatus/plugins/audioscrobbler"
+	_ "src.userspace.com.au/felix/mstatus/plugins/bar"
+	_ "src.userspace.com.au/felix/mstatus/plugins/cmus"
+	_ "src.userspace.com.au/felix/mstatus/plugins/file"
+	_ "src.userspace.com.au/felix/mstatus/plugins/hook"
+	_ "src.userspace.com.au/felix/mstatus/plugins/jellyfin"
+	_ "src.userspace.com.au/felix/mstatus/plugins/kodi"
 	_ "src.userspace.com.au/felix/mstatus/plugins/lastfm"
 	_ "src.userspace.com.au/felix/mstatus/plugins/listenbrainz"
+	_ "src.userspace.com.au/felix/mstatus/plugins/maloja"
+	_ "src.userspace.com.au/felix/mstatus/plugins/mastodon"
+	_ "src.userspace.com.au/felix/mstatus/plugins/matrix"
+	_ "src.userspace.com.au/felix/mstatus/plugins/mattermost"
+	_ "src.userspace.com.au/felix/mstatus/plugins/moc"
 	_ "src.userspace.com.au/felix/mstatus/plugins/mpd"
+	_ "src.userspace.com.au/felix/mstatus/plugins/mpv"
+	_ "src.userspace.com.au/felix/mstatus/plugins/musicbrainz"
+	_ "src.userspace.com.au/felix/mstatus/plugins/notify"
+	_ "src.userspace.com.au/felix/mstatus/plugins/rocketchat"
 	_ "src.userspace.com.au/felix/mstatus/plugins/slack"
 	_ "src.userspace.com.au/felix/mstatus/plugins/spotify"
+	_ "src.userspace.com.au/felix/mstatus/plugins/subsonic"
 )
 
 func main() {
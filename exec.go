@@ -0,0 +1,534 @@
+package mstatus
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Roles an exec plugin can be loaded as.
+const (
+	RoleHandler = "handler"
+	RoleSource  = "source"
+)
+
+// Exec protocol message types.
+const (
+	MessageLoad   = "load"
+	MessageReady  = "ready"
+	MessageStatus = "status"
+	MessageLog    = "log"
+	MessageError  = "error"
+	MessageStop   = "stop"
+)
+
+// Message is a single line of the exec plugin protocol. See the README for
+// the protocol description.
+type Message struct {
+	Type    string            `json:"type"`
+	Name    string            `json:"name,omitempty"`
+	Role    string            `json:"role,omitempty"`
+	Config  map[string]string `json:"config,omitempty"`
+	Status  *WireStatus       `json:"status,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// WireStatus is the JSON form of a Status.
+type WireStatus struct {
+	State  State      `json:"state"`
+	Player Player     `json:"player"`
+	Track  *WireTrack `json:"track,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// WireTrack is the JSON form of a Track.
+type WireTrack struct {
+	ID               string   `json:"id,omitempty"`
+	Title            string   `json:"title,omitempty"`
+	Artist           string   `json:"artist,omitempty"`
+	Artists          []string `json:"artists,omitempty"`
+	Album            string   `json:"album,omitempty"`
+	AlbumArtist      string   `json:"album_artist,omitempty"`
+	TrackNumber      int      `json:"track_number,omitempty"`
+	DiscNumber       int      `json:"disc_number,omitempty"`
+	ReleaseDate      string   `json:"release_date,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	DurationMs       int64    `json:"duration_ms,omitempty"`
+	ElapsedMs        int64    `json:"elapsed_ms,omitempty"`
+	MbArtistID       string   `json:"mb_artist_id,omitempty"`
+	MbTrackID        string   `json:"mb_track_id,omitempty"`
+	MbReleaseID      string   `json:"mb_release_id,omitempty"`
+	MbReleaseTrackID string   `json:"mb_release_track_id,omitempty"`
+	MbReleaseGroupID string   `json:"mb_release_group_id,omitempty"`
+	MbWorkID         string   `json:"mb_work_id,omitempty"`
+	ISRC             string   `json:"isrc,omitempty"`
+	ArtworkURL       string   `json:"artwork_url,omitempty"`
+	ArtworkPath      string   `json:"artwork_path,omitempty"`
+	URI              string   `json:"uri,omitempty"`
+	Redacted         bool     `json:"redacted,omitempty"`
+}
+
+// NewWireStatus converts s to its JSON form.
+func NewWireStatus(s Status) *WireStatus {
+	out := &WireStatus{State: s.State, Player: s.Player}
+	if s.Error != nil {
+		out.Error = s.Error.Error()
+	}
+	if t := s.Track; t != nil {
+		out.Track = &WireTrack{
+			ID:               t.ID,
+			Title:            t.Title,
+			Artist:           t.Artist,
+			Artists:          t.Artists,
+			Album:            t.Album,
+			AlbumArtist:      t.AlbumArtist,
+			TrackNumber:      t.TrackNumber,
+			DiscNumber:       t.DiscNumber,
+			ReleaseDate:      t.ReleaseDate,
+			Tags:             t.Tags,
+			DurationMs:       t.Duration.Milliseconds(),
+			ElapsedMs:        t.Elapsed.Milliseconds(),
+			MbArtistID:       t.MbArtistID,
+			MbTrackID:        t.MbTrackID,
+			MbReleaseID:      t.MbReleaseID,
+			MbReleaseTrackID: t.MbReleaseTrackID,
+			MbReleaseGroupID: t.MbReleaseGroupID,
+			MbWorkID:         t.MbWorkID,
+			ISRC:             t.ISRC,
+			ArtworkURL:       t.ArtworkURL,
+			ArtworkPath:      t.ArtworkPath,
+			URI:              t.URI,
+			Redacted:         t.Redacted,
+		}
+	}
+	return out
+}
+
+// Status converts the JSON form back to a Status.
+func (w WireStatus) Status() Status {
+	out := Status{State: w.State, Player: w.Player}
+	if w.Error != "" {
+		out.Error = errors.New(w.Error)
+	}
+	if t := w.Track; t != nil {
+		out.Track = &Track{
+			ID:               t.ID,
+			Title:            t.Title,
+			Artist:           t.Artist,
+			Artists:          t.Artists,
+			Album:            t.Album,
+			AlbumArtist:      t.AlbumArtist,
+			TrackNumber:      t.TrackNumber,
+			DiscNumber:       t.DiscNumber,
+			ReleaseDate:      t.ReleaseDate,
+			Tags:             t.Tags,
+			Duration:         time.Duration(t.DurationMs) * time.Millisecond,
+			Elapsed:          time.Duration(t.ElapsedMs) * time.Millisecond,
+			MbArtistID:       t.MbArtistID,
+			MbTrackID:        t.MbTrackID,
+			MbReleaseID:      t.MbReleaseID,
+			MbReleaseTrackID: t.MbReleaseTrackID,
+			MbReleaseGroupID: t.MbReleaseGroupID,
+			MbWorkID:         t.MbWorkID,
+			ISRC:             t.ISRC,
+			ArtworkURL:       t.ArtworkURL,
+			ArtworkPath:      t.ArtworkPath,
+			URI:              t.URI,
+			Redacted:         t.Redacted,
+		}
+	}
+	return out
+}
+
+const (
+	execReadyTimeout = 10 * time.Second
+	execStopTimeout  = 5 * time.Second
+	execMinBackoff   = time.Second
+	execMaxBackoff   = time.Minute
+	// execQueueSize is the number of lines buffered for a program before
+	// it is considered stuck and restarted
+	execQueueSize = 64
+)
+
+// ExecPlugin runs an external program as a handler or source, exchanging
+// line delimited JSON messages over its stdin and stdout. The program is
+// restarted if it exits unexpectedly.
+type ExecPlugin struct {
+	name    string
+	role    string
+	command []string
+	config  map[string]string
+	log     Logger
+
+	events     chan Status
+	done       chan struct{}
+	stopping   atomic.Bool
+	minBackoff time.Duration
+
+	mu    sync.Mutex
+	proc  *execProcess
+	last  *Status
+	ready chan error
+}
+
+// execProcess is a single run of the program.
+type execProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	// lines are written to stdin in order, a nil line closes it
+	lines  chan []byte
+	exited chan struct{}
+	err    error
+}
+
+// queue adds a line for the writer without blocking, reporting whether
+// there was room.
+func (proc *execProcess) queue(b []byte) bool {
+	select {
+	case proc.lines <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+var _ Handler = (*ExecPlugin)(nil)
+var _ Source = (*ExecPlugin)(nil)
+
+// NewExecPlugin creates a plugin called name for the given role. The command
+// is read from the "exec" key of its scope when loaded.
+func NewExecPlugin(name, role string) *ExecPlugin {
+	return &ExecPlugin{
+		name:       name,
+		role:       role,
+		log:        func(...any) {},
+		events:     make(chan Status),
+		done:       make(chan struct{}),
+		minBackoff: execMinBackoff,
+	}
+}
+
+func (p *ExecPlugin) Name() string {
+	return p.name
+}
+
+func (p *ExecPlugin) Load(sess *Session, log Logger) error {
+	if log != nil {
+		p.log = log
+	}
+	var err error
+	if p.command, err = splitCommand(sess.ConfigString(p.name, "exec")); err != nil {
+		return fmt.Errorf("invalid %s.exec: %w", p.name, err)
+	}
+	if len(p.command) == 0 {
+		return fmt.Errorf("missing %s.exec command", p.name)
+	}
+	p.config = sess.ConfigScope(p.name)
+	delete(p.config, "exec")
+
+	if err := p.start(); err != nil {
+		return err
+	}
+	go p.supervise()
+	return nil
+}
+
+// start launches the program and waits for it to be ready.
+func (p *ExecPlugin) start() error {
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.name, err)
+	}
+
+	proc := &execProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		lines:  make(chan []byte, execQueueSize),
+		exited: make(chan struct{}),
+	}
+	ready := make(chan error, 1)
+	p.mu.Lock()
+	p.proc = proc
+	p.ready = ready
+	p.mu.Unlock()
+
+	go func() {
+		// Output must be read before waiting
+		p.read(stdout)
+		proc.err = cmd.Wait()
+		close(proc.exited)
+	}()
+	go p.write(proc)
+
+	if err := p.send(Message{
+		Type:   MessageLoad,
+		Name:   p.name,
+		Role:   p.role,
+		Config: p.config,
+	}); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("%s failed to load: %w", p.name, err)
+		}
+	case <-proc.exited:
+		return fmt.Errorf("%s exited: %v", p.name, proc.err)
+	case <-time.After(execReadyTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("%s failed to become ready", p.name)
+	}
+	p.log("exec plugin ready", p.name, cmd.Process.Pid)
+	return nil
+}
+
+// supervise restarts the program whenever it exits, until stopped.
+func (p *ExecPlugin) supervise() {
+	backoff := p.minBackoff
+	for {
+		p.mu.Lock()
+		proc := p.proc
+		p.mu.Unlock()
+
+		started := time.Now()
+		select {
+		case <-p.done:
+			return
+		case <-proc.exited:
+		}
+		if p.stopping.Load() {
+			return
+		}
+		p.log("exec plugin exited", p.name, proc.err)
+
+		if time.Since(started) > execMaxBackoff {
+			backoff = p.minBackoff
+		}
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > execMaxBackoff {
+				backoff = execMaxBackoff
+			}
+			err := p.start()
+			if err == nil {
+				break
+			}
+			p.log("failed to restart", p.name, err)
+		}
+
+		// Bring a restarted handler up to date
+		p.mu.Lock()
+		last := p.last
+		p.mu.Unlock()
+		if last != nil {
+			if err := p.send(Message{Type: MessageStatus, Status: NewWireStatus(*last)}); err != nil {
+				p.log("failed to send status", p.name, err)
+			}
+		}
+	}
+}
+
+// read handles messages from the program until its stdout closes.
+func (p *ExecPlugin) read(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			p.log("invalid message from", p.name, err)
+			continue
+		}
+		switch msg.Type {
+		case MessageReady, MessageError:
+			var err error
+			if msg.Type == MessageError {
+				err = errors.New(msg.Error)
+			}
+			p.mu.Lock()
+			ready := p.ready
+			p.ready = nil
+			p.mu.Unlock()
+			if ready != nil {
+				ready <- err
+			} else if err != nil {
+				p.log(p.name, "error:", err)
+			}
+		case MessageLog:
+			p.log(p.name, msg.Message)
+		case MessageStatus:
+			if p.role != RoleSource || msg.Status == nil {
+				continue
+			}
+			select {
+			case p.events <- msg.Status.Status():
+			case <-p.done:
+				// Keep draining so the program can exit
+			}
+		default:
+			p.log("unknown message from", p.name, msg.Type)
+		}
+	}
+}
+
+// write copies queued lines to the program's stdin until it exits, so a
+// program that stops reading cannot block the plugin.
+func (p *ExecPlugin) write(proc *execProcess) {
+	for {
+		select {
+		case <-proc.exited:
+			return
+		case b := <-proc.lines:
+			if b == nil {
+				proc.stdin.Close()
+				return
+			}
+			if _, err := proc.stdin.Write(b); err != nil {
+				// The program has closed its input or is exiting
+				p.log("failed to write to", p.name, err)
+				return
+			}
+		}
+	}
+}
+
+// send queues msg for the program. A program that has stopped reading is
+// killed so it is restarted and sent the last status.
+func (p *ExecPlugin) send(msg Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	proc := p.proc
+	p.mu.Unlock()
+	if proc == nil {
+		return fmt.Errorf("%s not running", p.name)
+	}
+	if !proc.queue(append(b, '\n')) {
+		proc.cmd.Process.Kill()
+		return fmt.Errorf("%s is not reading its input", p.name)
+	}
+	return nil
+}
+
+// Start forwards statuses to the program.
+func (p *ExecPlugin) Start(events <-chan Status) {
+	for event := range events {
+		p.mu.Lock()
+		e := event
+		p.last = &e
+		p.mu.Unlock()
+		if err := p.send(Message{Type: MessageStatus, Status: NewWireStatus(event)}); err != nil {
+			p.log("failed to send status", p.name, err)
+		}
+	}
+}
+
+// Watch blocks until the plugin is stopped, the program sends statuses in
+// the background.
+func (p *ExecPlugin) Watch() error {
+	<-p.done
+	return nil
+}
+
+func (p *ExecPlugin) Events() chan Status {
+	return p.events
+}
+
+func (p *ExecPlugin) Stop() error {
+	if p.stopping.Swap(true) {
+		return nil
+	}
+	close(p.done)
+	if err := p.send(Message{Type: MessageStop}); err != nil {
+		p.log("failed to send stop", p.name, err)
+	}
+
+	p.mu.Lock()
+	proc := p.proc
+	p.mu.Unlock()
+	if proc == nil {
+		return nil
+	}
+	// Close stdin once the stop message is written
+	if !proc.queue(nil) {
+		proc.cmd.Process.Kill()
+	}
+
+	select {
+	case <-proc.exited:
+	case <-time.After(execStopTimeout):
+		p.log("killing", p.name)
+		return proc.cmd.Process.Kill()
+	}
+	return nil
+}
+
+// splitCommand splits s into words as a shell would, allowing arguments
+// with spaces to be single or double quoted or escaped with a backslash.
+// Variables and other expansions are not supported.
+func splitCommand(s string) ([]string, error) {
+	var out []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				out = append(out, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		out = append(out, word.String())
+	}
+	return out, nil
+}
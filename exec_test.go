@@ -0,0 +1,213 @@
+package mstatus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExecHelperProcess is not a real test, it runs the reference plugin
+// when the test binary is executed by an ExecPlugin.
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv("MSTATUS_EXEC_HELPER") != "1" {
+		t.Skip("helper process")
+	}
+	referencePlugin(os.Stdin, os.Stdout)
+	os.Exit(0)
+}
+
+// referencePlugin is a minimal implementation of the exec protocol. As a
+// handler it logs the title of each status received, as a source it emits
+// a status for the configured title. If "crash" is configured it exits
+// after the first status, if "hang" is configured it stops reading for that
+// long once ready.
+func referencePlugin(in io.Reader, out io.Writer) {
+	enc := json.NewEncoder(out)
+	scanner := bufio.NewScanner(in)
+	var cfg map[string]string
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			enc.Encode(Message{Type: MessageError, Error: err.Error()})
+			continue
+		}
+		switch msg.Type {
+		case MessageLoad:
+			cfg = msg.Config
+			if cfg["fail"] != "" {
+				enc.Encode(Message{Type: MessageError, Error: cfg["fail"]})
+				return
+			}
+			enc.Encode(Message{Type: MessageReady})
+			if d, err := time.ParseDuration(cfg["hang"]); err == nil {
+				time.Sleep(d)
+			}
+			if msg.Role == RoleSource {
+				enc.Encode(Message{Type: MessageStatus, Status: NewWireStatus(Status{
+					State:  StatePlaying,
+					Player: Player{Name: msg.Name},
+					Track:  &Track{Title: cfg["title"], Duration: time.Minute},
+				})})
+			}
+		case MessageStatus:
+			enc.Encode(Message{Type: MessageLog, Message: "got " + msg.Status.Track.Title})
+			if cfg["crash"] != "" {
+				os.Exit(1)
+			}
+		case MessageStop:
+			return
+		}
+	}
+}
+
+func execSession(t *testing.T, cfg string) *Session {
+	t.Helper()
+	t.Setenv("MSTATUS_EXEC_HELPER", "1")
+	sess, err := readConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sess
+}
+
+func helperCommand() string {
+	return fmt.Sprintf("%s -test.run=^TestExecHelperProcess$", os.Args[0])
+}
+
+func TestExecHandler(t *testing.T) {
+	sess := execSession(t, "hook.exec="+helperCommand()+"\nhook.crash=yes\n")
+
+	logs := make(chan string, 10)
+	p := NewExecPlugin("hook", RoleHandler)
+	p.minBackoff = 10 * time.Millisecond
+	err := p.Load(sess, func(v ...any) {
+		logs <- fmt.Sprint(v...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	ch := make(chan Status)
+	go p.Start(ch)
+	ch <- Status{State: StatePlaying, Track: &Track{Title: "first"}}
+
+	// The plugin crashes after each status and should be restarted and
+	// sent the last status again
+	want := []string{"got first", "got first"}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case l := <-logs:
+			t.Log(l)
+			if strings.HasSuffix(l, want[0]) {
+				want = want[1:]
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	close(ch)
+}
+
+func TestExecSource(t *testing.T) {
+	sess := execSession(t, "player.exec="+helperCommand()+"\nplayer.title=from plugin\n")
+
+	p := NewExecPlugin("player", RoleSource)
+	if err := p.Load(sess, Logger(t.Log)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case s := <-p.Events():
+		if s.State != StatePlaying || s.Track == nil {
+			t.Fatalf("got %#v", s)
+		}
+		if s.Track.Title != "from plugin" || s.Track.Duration != time.Minute {
+			t.Errorf("got %#v", s.Track)
+		}
+		if s.Player.Name != "player" {
+			t.Errorf("got player %q", s.Player.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for status")
+	}
+
+	watched := make(chan error)
+	go func() { watched <- p.Watch() }()
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-watched; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecLoadError(t *testing.T) {
+	sess := execSession(t, "broken.exec="+helperCommand()+"\nbroken.fail=bad config\n")
+
+	p := NewExecPlugin("broken", RoleHandler)
+	err := p.Load(sess, Logger(t.Log))
+	if err == nil || !strings.Contains(err.Error(), "bad config") {
+		t.Fatalf("got %v, want load error", err)
+	}
+}
+
+func TestExecStuckHandler(t *testing.T) {
+	sess := execSession(t, "hook.exec="+helperCommand()+"\nhook.hang=1s\n")
+
+	p := NewExecPlugin("hook", RoleHandler)
+	p.minBackoff = 10 * time.Millisecond
+	if err := p.Load(sess, Logger(t.Log)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough to fill the pipe and the queue
+	title := strings.Repeat("x", 4096)
+	ch := make(chan Status)
+	go p.Start(ch)
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		ch <- Status{State: StatePlaying, Track: &Track{Title: title}}
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("sending blocked for %s", d)
+	}
+	close(ch)
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := map[string][]string{
+		"":                        nil,
+		"hook":                    {"hook"},
+		"  hook  -v\targ ":        {"hook", "-v", "arg"},
+		`"/opt/My Hooks/hook" -v`: {"/opt/My Hooks/hook", "-v"},
+		`hook 'it''s' "a \"b\""`:  {"hook", "its", `a "b"`},
+		`hook a\ b ''`:            {"hook", "a b", ""},
+		`hook 'back\slash'`:       {"hook", `back\slash`},
+	}
+	for in, want := range tests {
+		got, err := splitCommand(in)
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got %q, want %q", in, got, want)
+		}
+	}
+	for _, in := range []string{`hook "open`, `hook \`} {
+		if _, err := splitCommand(in); err == nil {
+			t.Errorf("%q expected error", in)
+		}
+	}
+}
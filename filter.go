@@ -0,0 +1,215 @@
+package mstatus
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Filter suppresses or rewrites statuses before they reach a handler. The
+// rules are read from the handler's scope:
+//
+//	slack.exclude.artist=^(Brown Noise|Rain Sounds)$
+//	slack.exclude.hours=22:00-07:00
+//	slack.redact.album=(?i)podcast
+//
+// Excluded statuses are sent as stopped so the handler clears anything it
+// previously published. Redacted statuses keep their state but the track
+// details are replaced with placeholder text, and are not scrobbled.
+type Filter struct {
+	rules      []rule
+	dryRun     bool
+	redactText string
+	log        Logger
+	now        func() time.Time
+
+	lastMatch string
+}
+
+type ruleAction string
+
+const (
+	actionExclude ruleAction = "exclude"
+	actionRedact  ruleAction = "redact"
+)
+
+// filterFields are the fields rules may match against.
+var filterFields = []string{"artist", "title", "album", "file", "player", "hours"}
+
+type rule struct {
+	name    string
+	action  ruleAction
+	field   string
+	re      *regexp.Regexp
+	windows []window
+}
+
+// window is a time of day range, which may wrap past midnight.
+type window struct {
+	start, end time.Duration
+}
+
+func (w window) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return d >= w.start && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+const defaultRedactText = "something"
+
+// LoadFilter reads the filter rules for scope. It returns nil if there are
+// none.
+func LoadFilter(sess *Session, scope string, log Logger) (*Filter, error) {
+	out := &Filter{
+		dryRun:     sess.ConfigBool(scope, "filterDryRun"),
+		redactText: defaultRedactText,
+		log:        log,
+		now:        time.Now,
+	}
+	if out.log == nil {
+		out.log = func(...any) {}
+	}
+	if s := sess.ConfigString(scope, "redactText"); s != "" {
+		out.redactText = s
+	}
+
+	for _, action := range []ruleAction{actionExclude, actionRedact} {
+		for _, field := range filterFields {
+			key := string(action) + "." + field
+			v := sess.ConfigString(scope, key)
+			if v == "" {
+				continue
+			}
+			r := rule{name: scope + "." + key, action: action, field: field}
+			if field == "hours" {
+				for _, s := range strings.Split(v, ",") {
+					w, err := parseWindow(strings.TrimSpace(s))
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s: %w", r.name, err)
+					}
+					r.windows = append(r.windows, w)
+				}
+			} else {
+				re, err := regexp.Compile(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s: %w", r.name, err)
+				}
+				r.re = re
+			}
+			out.rules = append(out.rules, r)
+		}
+	}
+	if len(out.rules) == 0 {
+		return nil, nil
+	}
+	return out, nil
+}
+
+// parseWindow parses a range in the form 22:00-07:00.
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return window{}, fmt.Errorf("time range %q requires a start and end", s)
+	}
+	var out window
+	for _, p := range []struct {
+		s string
+		d *time.Duration
+	}{{from, &out.start}, {to, &out.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(p.s))
+		if err != nil {
+			return window{}, err
+		}
+		*p.d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return out, nil
+}
+
+// Apply returns the status to send to the handler. A nil filter returns s
+// unchanged.
+func (f *Filter) Apply(s Status) Status {
+	if f == nil {
+		return s
+	}
+	r := f.match(s)
+	name := ""
+	if r != nil {
+		name = r.name
+	}
+	if name != f.lastMatch {
+		f.lastMatch = name
+		if r != nil {
+			prefix := "filter matched"
+			if f.dryRun {
+				prefix = "filter dry-run matched"
+			}
+			f.log(prefix, r.name, s.Track)
+		}
+	}
+	if r == nil || f.dryRun {
+		return s
+	}
+
+	switch r.action {
+	case actionExclude:
+		return Status{State: StateStopped, Player: s.Player}
+	case actionRedact:
+		if s.Track == nil {
+			break
+		}
+		t := Track{
+			ID:       s.Track.ID,
+			Title:    f.redactText,
+			Duration: s.Track.Duration,
+			Elapsed:  s.Track.Elapsed,
+			Redacted: true,
+		}
+		s.Track = &t
+	}
+	return s
+}
+
+// match returns the first rule matching s, exclusions first.
+func (f *Filter) match(s Status) *rule {
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.field == "hours" {
+			now := f.now()
+			for _, w := range r.windows {
+				if w.contains(now) {
+					return r
+				}
+			}
+			continue
+		}
+		if r.field == "player" {
+			if r.re.MatchString(s.Player.Name) {
+				return r
+			}
+			continue
+		}
+		if s.Track == nil {
+			continue
+		}
+		var values []string
+		switch r.field {
+		case "artist":
+			values = append([]string{s.Track.Artist, s.Track.AlbumArtist}, s.Track.Artists...)
+		case "title":
+			values = []string{s.Track.Title}
+		case "album":
+			values = []string{s.Track.Album}
+		case "file":
+			values = []string{s.Track.URI}
+		}
+		for _, v := range values {
+			if v != "" && r.re.MatchString(v) {
+				return r
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package mstatus
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	cfg := `
+slack.exclude.artist=^Rain Sounds$
+slack.exclude.file=^podcasts/
+slack.exclude.player=(?i)^spotify$
+slack.exclude.hours=22:00-07:00,12:00-12:30
+slack.redact.album=(?i)guilty
+slack.redactText=a song
+`
+	sess, err := readConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		status Status
+		now    time.Time
+		want   Status
+	}{
+		"pass": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title", Artist: "artist"}},
+			want:   Status{State: StatePlaying, Track: &Track{Title: "title", Artist: "artist"}},
+		},
+		"artist": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title", Artist: "Rain Sounds"}},
+			want:   Status{State: StateStopped},
+		},
+		"artists": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title", Artist: "x", Artists: []string{"x", "Rain Sounds"}}},
+			want:   Status{State: StateStopped},
+		},
+		"file": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title", URI: "podcasts/episode.mp3"}},
+			want:   Status{State: StateStopped},
+		},
+		"player": {
+			status: Status{State: StatePlaying, Player: Player{Name: "spotify"}, Track: &Track{Title: "title"}},
+			want:   Status{State: StateStopped, Player: Player{Name: "spotify"}},
+		},
+		"night": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title"}},
+			now:    time.Date(2023, 1, 1, 23, 0, 0, 0, time.UTC),
+			want:   Status{State: StateStopped},
+		},
+		"early": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title"}},
+			now:    time.Date(2023, 1, 1, 6, 59, 0, 0, time.UTC),
+			want:   Status{State: StateStopped},
+		},
+		"lunch": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title"}},
+			now:    time.Date(2023, 1, 1, 12, 15, 0, 0, time.UTC),
+			want:   Status{State: StateStopped},
+		},
+		"after lunch": {
+			status: Status{State: StatePlaying, Track: &Track{Title: "title"}},
+			now:    time.Date(2023, 1, 1, 12, 30, 0, 0, time.UTC),
+			want:   Status{State: StatePlaying, Track: &Track{Title: "title"}},
+		},
+		"redact": {
+			status: Status{State: StatePlaying, Track: &Track{ID: "id", Title: "title", Artist: "artist", Album: "Guilty Pleasures", Duration: time.Minute}},
+			want:   Status{State: StatePlaying, Track: &Track{ID: "id", Title: "a song", Duration: time.Minute}},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, err := LoadFilter(sess, "slack", Logger(t.Log))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.now = func() time.Time {
+				if tt.now.IsZero() {
+					return day
+				}
+				return tt.now
+			}
+			got := f.Apply(tt.status)
+			if got.State != tt.want.State || got.Player != tt.want.Player {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+			if (got.Track == nil) != (tt.want.Track == nil) {
+				t.Fatalf("got track %v, want %v", got.Track, tt.want.Track)
+			}
+			if got.Track != nil && got.Track.String() != tt.want.Track.String() {
+				t.Fatalf("got track %s, want %s", got.Track, tt.want.Track)
+			}
+
+			// Dry run should always pass the status through
+			f.dryRun = true
+			if got := f.Apply(tt.status); got.State != tt.status.State || got.Track != tt.status.Track {
+				t.Fatalf("dry run got %#v, want %#v", got, tt.status)
+			}
+		})
+	}
+
+	f, err := LoadFilter(sess, "listenbrainz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		t.Errorf("got %v, want nil filter", f)
+	}
+}
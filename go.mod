@@ -4,13 +4,14 @@ go 1.20
 
 require (
 	github.com/fhs/gompd/v2 v2.2.0
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/shkh/lastfm-go v0.0.0-20191215035245-89a801c244e0
 	github.com/zmb3/spotify/v2 v2.3.1
+	golang.org/x/net v0.12.0
 )
 
 require (
 	github.com/golang/protobuf v1.5.3 // indirect
-	golang.org/x/net v0.12.0 // indirect
 	golang.org/x/oauth2 v0.10.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
@@ -0,0 +1,282 @@
+package mstatus
+
+import (
+	"fmt"
+	"time"
+)
+
+// ListenType is the kind of event emitted by a ListenTracker.
+type ListenType string
+
+const (
+	// ListenNowPlaying is emitted once when a play instance starts
+	ListenNowPlaying ListenType = "playing_now"
+	// ListenCompleted is emitted once when a play instance ends having
+	// satisfied the listen rule
+	ListenCompleted ListenType = "single"
+)
+
+// Listen is a single play instance of a track.
+type Listen struct {
+	Type   ListenType
+	Player Player
+	Track  Track
+	// StartedAt is when the play instance started
+	StartedAt time.Time
+	// Listened is the time actually spent listening, excluding pauses and
+	// seeks
+	Listened time.Duration
+}
+
+func (l Listen) String() string {
+	return fmt.Sprintf("%s %s (%s)", l.Type, l.Track, l.Listened.Round(time.Second))
+}
+
+// ListenRule determines when a play instance counts as a listen.
+type ListenRule struct {
+	// MinDuration is the shortest track that can be counted
+	MinDuration time.Duration
+	// Fraction of the track duration that must be listened to
+	Fraction float64
+	// MaxThreshold caps the listening time required for long tracks
+	MaxThreshold time.Duration
+}
+
+// DefaultListenRule follows the ListenBrainz and Last.fm guidelines:
+// listens should be submitted for tracks when the user has listened to
+// half the track or 4 minutes of the track, whichever is lower.
+// https://listenbrainz.readthedocs.io/en/latest/users/api/core/#post--1-submit-listens
+var DefaultListenRule = ListenRule{
+	MinDuration:  30 * time.Second,
+	Fraction:     0.5,
+	MaxThreshold: 4 * time.Minute,
+}
+
+// Threshold returns the listening time required for a track of duration d.
+// An unknown duration requires MaxThreshold.
+func (r ListenRule) Threshold(d time.Duration) time.Duration {
+	if d <= 0 {
+		return r.MaxThreshold
+	}
+	t := time.Duration(float64(d) * r.Fraction)
+	if r.MaxThreshold > 0 && t > r.MaxThreshold {
+		t = r.MaxThreshold
+	}
+	return t
+}
+
+// Satisfied reports whether listening for l to a track of duration d
+// counts as a listen.
+func (r ListenRule) Satisfied(d, l time.Duration) bool {
+	if d > 0 && d < r.MinDuration {
+		return false
+	}
+	return l > 0 && l >= r.Threshold(d)
+}
+
+// LoadListenRule reads listen rule overrides for scope, starting from
+// DefaultListenRule.
+func LoadListenRule(sess *Session, scope string) (ListenRule, error) {
+	out := DefaultListenRule
+	if s := sess.ConfigString(scope, "minTrackLength"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return out, err
+		}
+		out.MinDuration = d
+	}
+	if i := sess.ConfigInt(scope, "listenPercent"); i > 0 {
+		out.Fraction = float64(i) / 100
+	}
+	if s := sess.ConfigString(scope, "listenMax"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return out, err
+		}
+		out.MaxThreshold = d
+	}
+	return out, nil
+}
+
+// seekTolerance allows for jitter between the source clock and ours.
+const seekTolerance = 2 * time.Second
+
+// ListenTracker turns a stream of Status updates into Listen events. It
+// tracks each play instance of a track separately so repeats are counted,
+// and only credits time actually spent listening so pauses and seeks do
+// not inflate a listen.
+type ListenTracker struct {
+	rule ListenRule
+	now  func() time.Time
+
+	current *play
+}
+
+type play struct {
+	listen  Listen
+	playing bool
+	elapsed time.Duration
+	seen    time.Time
+}
+
+// NewListenTracker creates a tracker using rule.
+func NewListenTracker(rule ListenRule) *ListenTracker {
+	return &ListenTracker{
+		rule: rule,
+		now:  time.Now,
+	}
+}
+
+// Update consumes a single status and returns any resulting events.
+func (t *ListenTracker) Update(s Status) []Listen {
+	now := t.now()
+	var out []Listen
+
+	// A redacted track is placeholder text, end any play instead
+	if s.Track != nil && s.Track.Redacted {
+		s = Status{State: StateStopped, Player: s.Player}
+	}
+
+	switch s.State {
+	case StatePlaying:
+		if s.Track == nil {
+			break
+		}
+		if t.current != nil && t.isNewPlay(s, now) {
+			out = append(out, t.end()...)
+		}
+		if t.current == nil {
+			t.current = &play{
+				listen: Listen{
+					Type:      ListenNowPlaying,
+					Player:    s.Player,
+					Track:     *s.Track,
+					StartedAt: now,
+				},
+				playing: true,
+				elapsed: s.Track.Elapsed,
+				seen:    now,
+			}
+			out = append(out, t.current.listen)
+			break
+		}
+		t.credit(s.Track, now)
+
+	case StatePaused:
+		if t.current != nil {
+			t.current.playing = false
+		}
+
+	case StateStopped, StateError:
+		out = append(out, t.end()...)
+	}
+	return out
+}
+
+// Flush ends the current play instance, if any.
+func (t *ListenTracker) Flush() []Listen {
+	return t.end()
+}
+
+// Run feeds the tracker from in until it is closed, sending events on the
+// returned channel. The channel is closed after the final play instance is
+// flushed.
+func (t *ListenTracker) Run(in <-chan Status) <-chan Listen {
+	out := make(chan Listen)
+	go func() {
+		defer close(out)
+		for s := range in {
+			for _, l := range t.Update(s) {
+				out <- l
+			}
+		}
+		for _, l := range t.Flush() {
+			out <- l
+		}
+	}()
+	return out
+}
+
+// isNewPlay determines if s starts a new play instance.
+func (t *ListenTracker) isNewPlay(s Status, now time.Time) bool {
+	cur := t.current
+	if !sameTrack(&cur.listen.Track, s.Track) || cur.listen.Player != s.Player {
+		return true
+	}
+	elapsed := s.Track.Elapsed
+	if elapsed >= cur.elapsed {
+		return false
+	}
+	// Elapsed went backwards. If playback restarted near the beginning
+	// after reaching the end of the track then it is a repeat, otherwise
+	// it is a seek within the same play.
+	var wall time.Duration
+	if cur.playing {
+		wall = now.Sub(cur.seen)
+	}
+	restarted := elapsed <= wall+seekTolerance
+	if d := s.Track.Duration; d > 0 {
+		return restarted && cur.elapsed+wall+seekTolerance >= d
+	}
+	return restarted && cur.elapsed > seekTolerance
+}
+
+// sameTrack reports whether a and b are the same track. Some sources have
+// no ID or keep it for every track of a stream, so the details must agree
+// too. Details missing from either are ignored as sources may fill them in
+// over time.
+func sameTrack(a, b *Track) bool {
+	if a.ID != b.ID {
+		return false
+	}
+	for _, f := range [][2]string{
+		{a.Title, b.Title},
+		{a.Artist, b.Artist},
+		{a.Album, b.Album},
+		{a.URI, b.URI},
+	} {
+		if f[0] != "" && f[1] != "" && f[0] != f[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// credit adds listening time for the current play.
+func (t *ListenTracker) credit(tr *Track, now time.Time) {
+	cur := t.current
+	if cur.playing {
+		wall := now.Sub(cur.seen)
+		delta := tr.Elapsed - cur.elapsed
+		switch {
+		case tr.Elapsed == 0 && cur.elapsed == 0:
+			// Source does not report position
+			cur.listen.Listened += wall
+		case delta > wall:
+			// Seeked forward
+			cur.listen.Listened += wall
+		case delta > 0:
+			cur.listen.Listened += delta
+		}
+	}
+	cur.playing = true
+	cur.elapsed = tr.Elapsed
+	cur.seen = now
+	// Keep the latest metadata, sources may fill it in over time
+	cur.listen.Track = *tr
+}
+
+// end finishes the current play instance.
+func (t *ListenTracker) end() []Listen {
+	cur := t.current
+	t.current = nil
+	if cur == nil {
+		return nil
+	}
+	if !t.rule.Satisfied(cur.listen.Track.Duration, cur.listen.Listened) {
+		return nil
+	}
+	l := cur.listen
+	l.Type = ListenCompleted
+	return []Listen{l}
+}
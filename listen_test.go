@@ -0,0 +1,247 @@
+package mstatus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// step is a status seen at an offset from the start of a test.
+type step struct {
+	at      time.Duration
+	state   State
+	id      string
+	elapsed time.Duration
+}
+
+func TestListenTracker(t *testing.T) {
+	const duration = 3 * time.Minute
+
+	// playFrom generates a status every 10s of uninterrupted playback.
+	playFrom := func(at, elapsed, length time.Duration, id string) []step {
+		var out []step
+		for i := time.Duration(0); i <= length; i += 10 * time.Second {
+			out = append(out, step{at + i, StatePlaying, id, elapsed + i})
+		}
+		return out
+	}
+	concat := func(ss ...[]step) []step {
+		var out []step
+		for _, s := range ss {
+			out = append(out, s...)
+		}
+		return out
+	}
+	// noPosition removes elapsed time, as sources such as lastfm do.
+	noPosition := func(ss []step) []step {
+		for i := range ss {
+			ss[i].elapsed = 0
+		}
+		return ss
+	}
+
+	tests := map[string]struct {
+		steps []step
+		// Listened duration of each completed listen
+		completed []time.Duration
+		playing   int
+	}{
+		"full play": {
+			steps:     playFrom(0, 0, duration, "a"),
+			completed: []time.Duration{duration},
+			playing:   1,
+		},
+		"short play": {
+			steps:   playFrom(0, 0, time.Minute, "a"),
+			playing: 1,
+		},
+		"track change": {
+			steps: concat(
+				playFrom(0, 0, 2*time.Minute, "a"),
+				playFrom(2*time.Minute+10*time.Second, 0, time.Minute, "b"),
+			),
+			completed: []time.Duration{2 * time.Minute},
+			playing:   2,
+		},
+		"repeat": {
+			steps: concat(
+				playFrom(0, 0, duration, "a"),
+				playFrom(duration+10*time.Second, 0, duration, "a"),
+			),
+			completed: []time.Duration{duration, duration},
+			playing:   2,
+		},
+		"seek forward": {
+			// Jump from 20s to 2m50s then play to the end
+			steps: concat(
+				playFrom(0, 0, 20*time.Second, "a"),
+				playFrom(30*time.Second, 2*time.Minute+50*time.Second, 10*time.Second, "a"),
+			),
+			playing: 1,
+		},
+		"seek back": {
+			// Listen for 1m, back to the start, listen for 1m
+			steps: concat(
+				playFrom(0, 0, time.Minute, "a"),
+				playFrom(70*time.Second, 0, time.Minute, "a"),
+			),
+			completed: []time.Duration{2 * time.Minute},
+			playing:   1,
+		},
+		"pause": {
+			// Listen for 1m, pause for 10m, listen for 40s
+			steps: concat(
+				playFrom(0, 0, time.Minute, "a"),
+				[]step{{61 * time.Second, StatePaused, "a", time.Minute}},
+				playFrom(11*time.Minute, time.Minute, 40*time.Second, "a"),
+			),
+			completed: []time.Duration{100 * time.Second},
+			playing:   1,
+		},
+		"stopped": {
+			steps: concat(
+				playFrom(0, 0, time.Minute, "a"),
+				[]step{{61 * time.Second, StateStopped, "", 0}},
+				playFrom(2*time.Minute, time.Minute, time.Minute, "a"),
+			),
+			playing: 2,
+		},
+		"no position": {
+			steps: concat(
+				noPosition(playFrom(0, 0, 2*time.Minute, "a")),
+				[]step{{2*time.Minute + 10*time.Second, StateStopped, "", 0}},
+			),
+			completed: []time.Duration{2 * time.Minute},
+			playing:   1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+			now := start
+			tr := NewListenTracker(DefaultListenRule)
+			tr.now = func() time.Time { return now }
+
+			var got []Listen
+			for _, s := range tt.steps {
+				now = start.Add(s.at)
+				st := Status{State: s.state, Player: Player{Name: "test"}}
+				if s.id != "" {
+					st.Track = &Track{ID: s.id, Duration: duration, Elapsed: s.elapsed}
+				}
+				got = append(got, tr.Update(st)...)
+			}
+			got = append(got, tr.Flush()...)
+
+			var playing int
+			var completed []time.Duration
+			for _, l := range got {
+				switch l.Type {
+				case ListenNowPlaying:
+					playing++
+				case ListenCompleted:
+					completed = append(completed, l.Listened)
+					if l.StartedAt.Before(start) {
+						t.Errorf("invalid start %s", l.StartedAt)
+					}
+				}
+			}
+			if playing != tt.playing {
+				t.Errorf("got %d now playing, want %d", playing, tt.playing)
+			}
+			if len(completed) != len(tt.completed) {
+				t.Fatalf("got %d completed %v, want %d", len(completed), completed, len(tt.completed))
+			}
+			for i := range completed {
+				if completed[i] != tt.completed[i] {
+					t.Errorf("listen %d got %s, want %s", i, completed[i], tt.completed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestListenTrackerNoID(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tr := NewListenTracker(DefaultListenRule)
+	tr.now = func() time.Time { return now }
+
+	var got []Listen
+	play := func(track Track) {
+		for i := time.Duration(0); i <= 2*time.Minute; i += 10 * time.Second {
+			t := track
+			t.Elapsed = i
+			// Details may arrive after the track starts
+			if i > 0 {
+				t.Album = "album"
+			}
+			got = append(got, tr.Update(Status{State: StatePlaying, Track: &t})...)
+			now = now.Add(10 * time.Second)
+		}
+	}
+	play(Track{Title: "one", Artist: "artist", Duration: 3 * time.Minute})
+	play(Track{Title: "two", Artist: "artist", Duration: 3 * time.Minute})
+	got = append(got, tr.Flush()...)
+
+	var titles []string
+	for _, l := range got {
+		if l.Type == ListenCompleted {
+			titles = append(titles, l.Track.Title)
+		}
+	}
+	if fmt.Sprint(titles) != "[one two]" {
+		t.Errorf("got listens %q, want one and two", titles)
+	}
+}
+
+func TestListenTrackerRedacted(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tr := NewListenTracker(DefaultListenRule)
+	tr.now = func() time.Time { return now }
+
+	track := &Track{ID: "a", Title: "title", Duration: 3 * time.Minute}
+	redacted := &Track{ID: "a", Title: "something", Duration: 3 * time.Minute, Redacted: true}
+
+	var got []Listen
+	got = append(got, tr.Update(Status{State: StatePlaying, Track: track})...)
+	now = now.Add(2 * time.Minute)
+	played := *track
+	played.Elapsed = 2 * time.Minute
+	got = append(got, tr.Update(Status{State: StatePlaying, Track: &played})...)
+	// Ends the play in progress
+	got = append(got, tr.Update(Status{State: StatePlaying, Track: redacted})...)
+	now = now.Add(3 * time.Minute)
+	got = append(got, tr.Update(Status{State: StatePlaying, Track: redacted})...)
+	got = append(got, tr.Flush()...)
+
+	if len(got) != 2 || got[0].Type != ListenNowPlaying || got[1].Type != ListenCompleted {
+		t.Fatalf("got %v, want the first track only", got)
+	}
+	if got[1].Track.Redacted {
+		t.Errorf("redacted track submitted")
+	}
+}
+
+func TestListenRule(t *testing.T) {
+	tests := []struct {
+		duration, listened time.Duration
+		want               bool
+	}{
+		{0, 0, false},
+		{20 * time.Second, 20 * time.Second, false},
+		{time.Minute, 29 * time.Second, false},
+		{time.Minute, 30 * time.Second, true},
+		{20 * time.Minute, 5 * time.Minute, true},
+		{20 * time.Minute, 3 * time.Minute, false},
+		{0, 4 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		got := DefaultListenRule.Satisfied(tt.duration, tt.listened)
+		if got != tt.want {
+			t.Errorf("%s of %s got %t, want %t", tt.listened, tt.duration, got, tt.want)
+		}
+	}
+}
@@ -17,6 +17,13 @@ type Plugin interface {
 	//Run() error
 }
 
+// Instancer is implemented by plugins that can run more than once. Each
+// instance is configured under its own name.
+type Instancer interface {
+	Plugin
+	NewInstance(name string) Plugin
+}
+
 func Register(p Plugin) {
 	if p == nil {
 		panic("nil plugin")
@@ -0,0 +1,184 @@
+package audioscrobbler
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(newClient(scope))
+}
+
+func newClient(name string) *Client {
+	return &Client{
+		name:       name,
+		protocol:   protocol12,
+		clientID:   defaultClientID,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		rule:       mstatus.DefaultListenRule,
+		log:        func(...interface{}) {},
+	}
+}
+
+const (
+	scope = "audioscrobbler"
+	// GNU FM accepts any client ID
+	defaultClientID = "mst"
+	defaultURL12    = "https://turtle.libre.fm/"
+	defaultURL20    = "https://libre.fm/2.0/"
+)
+
+// Protocol versions
+const (
+	protocol12 = "1.2"
+	protocol20 = "2.0"
+)
+
+// errBadSession is returned when the session must be renewed.
+var errBadSession = errors.New("bad session")
+
+// scrobbler is a version of the Audioscrobbler protocol.
+type scrobbler interface {
+	// auth starts a new session
+	auth() error
+	nowPlaying(l mstatus.Listen) error
+	scrobble(l mstatus.Listen) error
+}
+
+// Client submits listens to Libre.fm, GNU FM or other services using the
+// Audioscrobbler 1.2 protocol or the 2.0 API.
+type Client struct {
+	// Configuration scope, differs for additional instances
+	name       string
+	protocol   string
+	apiURL     string
+	username   string
+	password   string
+	clientID   string
+	httpClient *http.Client
+	rule       mstatus.ListenRule
+	log        mstatus.Logger
+
+	scrobbler scrobbler
+}
+
+var (
+	_ mstatus.Handler   = (*Client)(nil)
+	_ mstatus.Instancer = (*Client)(nil)
+)
+
+func (c *Client) Name() string {
+	return c.name
+}
+
+// NewInstance implements mstatus.Instancer.
+func (c *Client) NewInstance(name string) mstatus.Plugin {
+	return newClient(name)
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(c.name, "protocol"); s != "" {
+		c.protocol = s
+	}
+	c.username = sess.ConfigString(c.name, "username")
+	c.password = sess.ConfigString(c.name, "password")
+	if c.username == "" || c.password == "" {
+		return fmt.Errorf("missing %s username or password", c.name)
+	}
+	c.apiURL = sess.ConfigString(c.name, "url")
+	if s := sess.ConfigString(c.name, "clientID"); s != "" {
+		c.clientID = s
+	}
+	var err error
+	if c.rule, err = mstatus.LoadListenRule(sess, c.name); err != nil {
+		return err
+	}
+
+	switch c.protocol {
+	case protocol12:
+		if c.apiURL == "" {
+			c.apiURL = defaultURL12
+		}
+		c.scrobbler = &v12{Client: c}
+	case protocol20:
+		if c.apiURL == "" {
+			c.apiURL = defaultURL20
+		}
+		v := &v20{
+			Client: c,
+			key:    sess.ConfigString(c.name, "key"),
+			secret: sess.ConfigString(c.name, "secret"),
+		}
+		// GNU FM does not check API keys
+		if v.key == "" {
+			v.key = md5sum(mstatus.ClientName)
+		}
+		if v.secret == "" {
+			v.secret = v.key
+		}
+		c.scrobbler = v
+	default:
+		return fmt.Errorf("invalid %s protocol %q", c.name, c.protocol)
+	}
+	if !strings.HasPrefix(c.apiURL, "http") {
+		c.apiURL = "https://" + c.apiURL
+	}
+
+	// A failed handshake is retried on the first submission
+	if err := c.scrobbler.auth(); err != nil {
+		c.log(c.name, "failed to authenticate", err)
+	}
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	tracker := mstatus.NewListenTracker(c.rule)
+	for l := range tracker.Run(events) {
+		var err error
+		switch l.Type {
+		case mstatus.ListenNowPlaying:
+			err = c.retry(l, c.scrobbler.nowPlaying)
+		case mstatus.ListenCompleted:
+			err = c.retry(l, c.scrobbler.scrobble)
+		}
+		if err != nil {
+			errorf("failed to submit %s: %s\n", l.Type, err)
+			continue
+		}
+		c.log(c.name, "submitted", l)
+	}
+}
+
+// retry renews the session and tries again if it has expired.
+func (c *Client) retry(l mstatus.Listen, fn func(mstatus.Listen) error) error {
+	err := fn(l)
+	if !errors.Is(err, errBadSession) {
+		return err
+	}
+	if err := c.scrobbler.auth(); err != nil {
+		return err
+	}
+	return fn(l)
+}
+
+func (c *Client) Stop() error {
+	return nil
+}
+
+func md5sum(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "audioscrobbler error: "+format, v...)
+}
@@ -0,0 +1,203 @@
+package audioscrobbler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+var testListen = mstatus.Listen{
+	Type: mstatus.ListenCompleted,
+	Track: mstatus.Track{
+		Title:       "title",
+		Artist:      "artist",
+		Album:       "album",
+		TrackNumber: 3,
+		Duration:    3 * time.Minute,
+		MbTrackID:   "mbid",
+	},
+	StartedAt: time.Unix(1700000000, 0),
+}
+
+func newTestClient(ts *httptest.Server) *Client {
+	c := newClient(scope)
+	c.apiURL = ts.URL + "/"
+	c.username = "user"
+	c.password = "pass"
+	c.httpClient = ts.Client()
+	return c
+}
+
+func TestV12(t *testing.T) {
+	var mu sync.Mutex
+	var handshakes int
+	session := "session1"
+	got := map[string]url.Values{}
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			q := r.URL.Query()
+			if q.Get("hs") != "true" || q.Get("p") != "1.2.1" || q.Get("u") != "user" || q.Get("c") != defaultClientID {
+				t.Errorf("got handshake %v", q)
+			}
+			if q.Get("a") != md5sum(md5sum("pass")+q.Get("t")) {
+				fmt.Fprintln(w, "BADAUTH")
+				return
+			}
+			handshakes++
+			session = "session" + strconv.Itoa(handshakes)
+			fmt.Fprintf(w, "OK\n%s\n%s/np\n%s/submit\n", session, ts.URL, ts.URL)
+		case "/np", "/submit":
+			if err := r.ParseForm(); err != nil {
+				t.Error(err)
+			}
+			if r.PostForm.Get("s") != session {
+				fmt.Fprintln(w, "BADSESSION")
+				return
+			}
+			got[r.URL.Path] = r.PostForm
+			fmt.Fprintln(w, "OK")
+		default:
+			t.Errorf("got path %q", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestClient(ts)
+	v := &v12{Client: c}
+	c.scrobbler = v
+	if err := v.auth(); err != nil {
+		t.Fatal(err)
+	}
+	if v.session != "session1" || v.submissionURL != ts.URL+"/submit" {
+		t.Errorf("got session %q, submission URL %q", v.session, v.submissionURL)
+	}
+
+	if err := c.retry(testListen, v.nowPlaying); err != nil {
+		t.Fatal(err)
+	}
+	np := got["/np"]
+	for k, expected := range map[string]string{"a": "artist", "t": "title", "b": "album", "l": "180", "n": "3", "m": "mbid"} {
+		if np.Get(k) != expected {
+			t.Errorf("got now playing %s=%q, want %q", k, np.Get(k), expected)
+		}
+	}
+
+	// An expired session is renewed
+	v.session = "expired"
+	if err := c.retry(testListen, v.scrobble); err != nil {
+		t.Fatal(err)
+	}
+	if handshakes != 2 {
+		t.Errorf("got %d handshakes, want 2", handshakes)
+	}
+	sub := got["/submit"]
+	for k, expected := range map[string]string{"a[0]": "artist", "t[0]": "title", "i[0]": "1700000000", "o[0]": "P", "l[0]": "180", "m[0]": "mbid"} {
+		if sub.Get(k) != expected {
+			t.Errorf("got submission %s=%q, want %q", k, sub.Get(k), expected)
+		}
+	}
+
+	c.password = "wrong"
+	if err := v.auth(); err == nil || err.Error() != "handshake failed: BADAUTH" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestV20(t *testing.T) {
+	var mu sync.Mutex
+	var sessions int
+	sessionKey := ""
+	got := map[string]url.Values{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form := r.PostForm
+		if form.Get("format") != "json" || form.Get("api_key") != "key" {
+			t.Errorf("got form %v", form)
+		}
+		sig := form.Get("api_sig")
+		signed := url.Values{}
+		for k, v := range form {
+			if k != "api_sig" && k != "format" {
+				signed[k] = v
+			}
+		}
+		if sig != (&v20{secret: "secret"}).sign(signed) {
+			fmt.Fprint(w, `{"error":13,"message":"Invalid method signature supplied"}`)
+			return
+		}
+		switch method := form.Get("method"); method {
+		case "auth.getMobileSession":
+			if form.Get("username") != "user" || form.Get("password") != "pass" {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"error":4,"message":"Invalid username or password"}`)
+				return
+			}
+			sessions++
+			sessionKey = "sk" + strconv.Itoa(sessions)
+			fmt.Fprintf(w, `{"session":{"name":"user","key":%q,"subscriber":0}}`, sessionKey)
+		case "track.updateNowPlaying", "track.scrobble":
+			if form.Get("sk") != sessionKey {
+				fmt.Fprint(w, `{"error":9,"message":"Invalid session key"}`)
+				return
+			}
+			got[method] = form
+			fmt.Fprint(w, `{}`)
+		default:
+			t.Errorf("got method %q", method)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestClient(ts)
+	v := &v20{Client: c, key: "key", secret: "secret"}
+	c.scrobbler = v
+	if err := v.auth(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.retry(testListen, v.nowPlaying); err != nil {
+		t.Fatal(err)
+	}
+	np := got["track.updateNowPlaying"]
+	for k, expected := range map[string]string{"artist": "artist", "track": "title", "album": "album", "duration": "180", "trackNumber": "3", "mbid": "mbid", "sk": "sk1"} {
+		if np.Get(k) != expected {
+			t.Errorf("got now playing %s=%q, want %q", k, np.Get(k), expected)
+		}
+	}
+	if _, ok := np["albumArtist"]; ok {
+		t.Error("got empty albumArtist")
+	}
+
+	// An expired session is renewed
+	v.sessionKey = "expired"
+	if err := c.retry(testListen, v.scrobble); err != nil {
+		t.Fatal(err)
+	}
+	sub := got["track.scrobble"]
+	for k, expected := range map[string]string{"artist[0]": "artist", "track[0]": "title", "timestamp[0]": "1700000000", "album[0]": "album", "sk": "sk2"} {
+		if sub.Get(k) != expected {
+			t.Errorf("got scrobble %s=%q, want %q", k, sub.Get(k), expected)
+		}
+	}
+
+	c.password = "wrong"
+	err := v.auth()
+	if err == nil || err.Error() != "auth.getMobileSession failed: 4 Invalid username or password" {
+		t.Errorf("got %v", err)
+	}
+}
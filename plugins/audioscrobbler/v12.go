@@ -0,0 +1,150 @@
+package audioscrobbler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+// v12 implements the Audioscrobbler 1.2.1 submission protocol.
+// https://www.last.fm/api/submissions
+type v12 struct {
+	*Client
+	session       string
+	nowPlayingURL string
+	submissionURL string
+}
+
+// auth performs the handshake.
+func (v *v12) auth() error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	q := url.Values{
+		"hs": {"true"},
+		"p":  {"1.2.1"},
+		"c":  {v.clientID},
+		"v":  {mstatus.Version()},
+		"u":  {v.username},
+		"t":  {ts},
+		"a":  {md5sum(md5sum(v.password) + ts)},
+	}
+	u, err := url.Parse(v.apiURL)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = q.Encode()
+	resp, err := v.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	lines, err := readLines(resp)
+	if err != nil {
+		return err
+	}
+	if lines[0] != "OK" {
+		return fmt.Errorf("handshake failed: %s", lines[0])
+	}
+	if len(lines) < 4 {
+		return fmt.Errorf("handshake failed: short response")
+	}
+	v.session, v.nowPlayingURL, v.submissionURL = lines[1], lines[2], lines[3]
+	return nil
+}
+
+func (v *v12) nowPlaying(l mstatus.Listen) error {
+	form := url.Values{
+		"a": {l.Track.Artist},
+		"t": {l.Track.Title},
+		"b": {l.Track.Album},
+		"l": {seconds(l.Track.Duration)},
+		"n": {number(l.Track.TrackNumber)},
+		"m": {l.Track.MbTrackID},
+	}
+	return v.post(v.nowPlayingURL, form)
+}
+
+func (v *v12) scrobble(l mstatus.Listen) error {
+	form := url.Values{
+		"a[0]": {l.Track.Artist},
+		"t[0]": {l.Track.Title},
+		"i[0]": {strconv.FormatInt(l.StartedAt.Unix(), 10)},
+		// Chosen by the user
+		"o[0]": {"P"},
+		"r[0]": {""},
+		"l[0]": {seconds(l.Track.Duration)},
+		"b[0]": {l.Track.Album},
+		"n[0]": {number(l.Track.TrackNumber)},
+		"m[0]": {l.Track.MbTrackID},
+	}
+	return v.post(v.submissionURL, form)
+}
+
+func (v *v12) post(uri string, form url.Values) error {
+	if v.session == "" {
+		return errBadSession
+	}
+	form.Set("s", v.session)
+	resp, err := v.httpClient.PostForm(uri, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	lines, err := readLines(resp)
+	if err != nil {
+		return err
+	}
+	switch lines[0] {
+	case "OK":
+		return nil
+	case "BADSESSION":
+		return errBadSession
+	default:
+		return fmt.Errorf("submission failed: %s", lines[0])
+	}
+}
+
+// readLines returns the non-empty lines of a response, of which there is at
+// least one.
+func readLines(resp *http.Response) ([]string, error) {
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("request failed: %d %q", resp.StatusCode, string(body))
+	}
+	var out []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if s := strings.TrimSpace(scanner.Text()); s != "" {
+			out = append(out, s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+	return out, nil
+}
+
+func seconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return strconv.Itoa(int(d.Seconds()))
+}
+
+func number(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
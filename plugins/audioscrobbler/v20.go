@@ -0,0 +1,153 @@
+package audioscrobbler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+// v20 implements the scrobbling methods of the Audioscrobbler 2.0 API.
+// https://www.last.fm/api/scrobbling
+type v20 struct {
+	*Client
+	key        string
+	secret     string
+	sessionKey string
+}
+
+// errInvalidSession is the API error code for an expired session.
+const errInvalidSession = 9
+
+// auth starts a mobile session with the username and password.
+func (v *v20) auth() error {
+	var r struct {
+		Session struct {
+			Key string `json:"key"`
+		} `json:"session"`
+	}
+	if err := v.call("auth.getMobileSession", url.Values{
+		"username": {v.username},
+		"password": {v.password},
+	}, &r); err != nil {
+		return err
+	}
+	if r.Session.Key == "" {
+		return fmt.Errorf("no session key")
+	}
+	v.sessionKey = r.Session.Key
+	return nil
+}
+
+func (v *v20) nowPlaying(l mstatus.Listen) error {
+	params := url.Values{
+		"artist": {l.Track.Artist},
+		"track":  {l.Track.Title},
+	}
+	setOptional(params, "", l)
+	return v.authCall("track.updateNowPlaying", params)
+}
+
+func (v *v20) scrobble(l mstatus.Listen) error {
+	params := url.Values{
+		"artist[0]":    {l.Track.Artist},
+		"track[0]":     {l.Track.Title},
+		"timestamp[0]": {strconv.FormatInt(l.StartedAt.Unix(), 10)},
+	}
+	setOptional(params, "[0]", l)
+	return v.authCall("track.scrobble", params)
+}
+
+// setOptional adds the optional track parameters that have values.
+func setOptional(params url.Values, suffix string, l mstatus.Listen) {
+	for k, val := range map[string]string{
+		"album":       l.Track.Album,
+		"albumArtist": l.Track.AlbumArtist,
+		"duration":    seconds(l.Track.Duration),
+		"trackNumber": number(l.Track.TrackNumber),
+		"mbid":        l.Track.MbTrackID,
+	} {
+		if val != "" {
+			params.Set(k+suffix, val)
+		}
+	}
+}
+
+func (v *v20) authCall(method string, params url.Values) error {
+	if v.sessionKey == "" {
+		return errBadSession
+	}
+	params.Set("sk", v.sessionKey)
+	return v.call(method, params, nil)
+}
+
+// APIError is an error response from the 2.0 API.
+type APIError struct {
+	Code    int    `json:"error"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// call performs a signed write method, decoding the response into out if
+// not nil.
+func (v *v20) call(method string, params url.Values, out interface{}) error {
+	params.Set("method", method)
+	params.Set("api_key", v.key)
+	params.Set("api_sig", v.sign(params))
+	// Not part of the signature
+	params.Set("format", "json")
+
+	resp, err := v.httpClient.PostForm(v.apiURL, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	var ae APIError
+	if err := json.Unmarshal(body, &ae); err != nil {
+		return fmt.Errorf("%s failed: %d %q", method, resp.StatusCode, string(body))
+	}
+	if ae.Code == errInvalidSession {
+		return errBadSession
+	}
+	if ae.Code != 0 {
+		return fmt.Errorf("%s failed: %w", method, &ae)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %d", method, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// sign returns the signature of the parameters: the md5 of the sorted
+// names and values followed by the secret.
+func (v *v20) sign(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(params.Get(k))
+	}
+	b.WriteString(v.secret)
+	return md5sum(b.String())
+}
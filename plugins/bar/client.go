@@ -0,0 +1,296 @@
+package bar
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+	"text/template"
+	"unicode/utf8"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		format: formatText,
+		out:    os.Stdout,
+		log:    func(...interface{}) {},
+	})
+}
+
+const (
+	scope           = "bar"
+	defaultTemplate = `{{if .Track.Title}}{{.Track.Artist}} - {{.Track.Title}}{{end}}`
+	defaultTooltip  = `{{.Track.Title}}{{if .Track.Artist}}
+{{.Track.Artist}}{{end}}{{if .Track.Album}}
+{{.Track.Album}}{{end}}`
+	i3barHeader = `{"version":1}` + "\n[\n"
+	// maxLine keeps a line, with the header and newline, within PIPE_BUF
+	// so FIFO writes are never split
+	maxLine = 4096 - len(i3barHeader) - 1
+)
+
+// Output formats
+const (
+	formatText   = "text"
+	formatWaybar = "waybar"
+	formatI3bar  = "i3bar"
+)
+
+// errNotRead is returned when a FIFO has no reader or is full. The line is
+// dropped and tried again with the next status.
+var errNotRead = errors.New("output not being read")
+
+// Client writes a line for each change to stdout, a FIFO or a file, for
+// status bars such as waybar, polybar, i3bar and i3blocks. A file is
+// rewritten with only the current line.
+type Client struct {
+	format  string
+	text    *template.Template
+	tooltip *template.Template
+	out     io.Writer
+	log     mstatus.Logger
+
+	// path is the output file, if not stdout
+	path   string
+	isFIFO bool
+	// pipe is open while the FIFO has a reader
+	pipe *os.File
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+// waybarLine is a line of waybar's custom module return-type json.
+type waybarLine struct {
+	Text    string `json:"text"`
+	Tooltip string `json:"tooltip,omitempty"`
+	Class   string `json:"class"`
+	Alt     string `json:"alt"`
+}
+
+// i3block is a block of the i3bar protocol.
+type i3block struct {
+	Name     string `json:"name"`
+	FullText string `json:"full_text"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "format"); s != "" {
+		c.format = strings.ToLower(s)
+	}
+	switch c.format {
+	case formatText, formatWaybar, formatI3bar:
+	default:
+		return fmt.Errorf("invalid bar format %q", c.format)
+	}
+
+	text := defaultTemplate
+	if s := sess.ConfigString(scope, "template"); s != "" {
+		text = s
+	}
+	var err error
+	if c.text, err = mstatus.NewTemplate("text", text); err != nil {
+		return err
+	}
+	tooltip := defaultTooltip
+	if s := sess.ConfigString(scope, "tooltip"); s != "" {
+		tooltip = s
+	}
+	if c.tooltip, err = mstatus.NewTemplate("tooltip", tooltip); err != nil {
+		return err
+	}
+
+	if p := sess.ConfigString(scope, "output"); p != "" && p != "-" {
+		return c.setOutput(p)
+	}
+	return nil
+}
+
+// setOutput writes to the FIFO or file at p rather than stdout.
+func (c *Client) setOutput(p string) error {
+	fi, err := os.Stat(p)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	c.path = p
+	c.isFIFO = err == nil && fi.Mode()&fs.ModeNamedPipe != 0
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	if c.path == "" {
+		io.WriteString(c.out, c.header())
+	}
+
+	var last string
+	for event := range events {
+		line, err := c.line(event)
+		if err != nil {
+			errorf("failed to format: %s\n", err)
+			continue
+		}
+		if line == last {
+			continue
+		}
+		if err := c.write(line); err != nil {
+			if !errors.Is(err, errNotRead) {
+				errorf("failed to write: %s\n", err)
+			}
+			continue
+		}
+		last = line
+	}
+}
+
+// header returns what a reader expects before the first line.
+func (c *Client) header() string {
+	if c.format == formatI3bar {
+		return i3barHeader
+	}
+	return ""
+}
+
+func (c *Client) write(line string) error {
+	switch {
+	case c.isFIFO:
+		return c.writeFIFO(line)
+	case c.path != "":
+		return mstatus.WriteFileAtomic(c.path, []byte(c.header()+line+"\n"), 0644)
+	}
+	_, err := fmt.Fprintln(c.out, line)
+	return err
+}
+
+// writeFIFO writes line without waiting for a reader, opening the FIFO for
+// each new reader. Lines are limited to maxLine so are never split.
+func (c *Client) writeFIFO(line string) error {
+	if c.pipe == nil {
+		f, err := os.OpenFile(c.path, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if errors.Is(err, syscall.ENXIO) {
+			return errNotRead
+		}
+		if err != nil {
+			return err
+		}
+		c.pipe = f
+		line = c.header() + line
+	}
+
+	err := writeNonblock(c.pipe, []byte(line+"\n"))
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EAGAIN):
+		return errNotRead
+	}
+	// The reader has gone, wait for the next
+	c.pipe.Close()
+	c.pipe = nil
+	if errors.Is(err, syscall.EPIPE) {
+		return errNotRead
+	}
+	return err
+}
+
+func (c *Client) line(s mstatus.Status) (string, error) {
+	if s.State != mstatus.StatePlaying && s.State != mstatus.StatePaused {
+		s.Track = nil
+	}
+	text, err := mstatus.ExecuteTemplate(c.text, s)
+	if err != nil {
+		return "", err
+	}
+	// Bars expect a single line
+	text = truncate(strings.ReplaceAll(text, "\n", " "), maxLine)
+
+	switch c.format {
+	case formatWaybar:
+		l := waybarLine{
+			Text:  text,
+			Class: string(s.State),
+			Alt:   string(s.State),
+		}
+		if s.Track != nil {
+			if l.Tooltip, err = mstatus.ExecuteTemplate(c.tooltip, s); err != nil {
+				return "", err
+			}
+		}
+		// Escaping may lengthen the text, shorten the tooltip first
+		for {
+			b, err := json.Marshal(l)
+			over := len(b) - maxLine
+			if err != nil || over <= 0 {
+				return string(b), err
+			}
+			if l.Tooltip != "" {
+				l.Tooltip = truncate(l.Tooltip, len(l.Tooltip)-over)
+			} else {
+				l.Text = truncate(l.Text, len(l.Text)-over)
+			}
+		}
+
+	case formatI3bar:
+		for {
+			b, err := json.Marshal([]i3block{{Name: "music-status", FullText: text}})
+			over := len(b) + 1 - maxLine
+			if err != nil || over <= 0 {
+				return string(b) + ",", err
+			}
+			text = truncate(text, len(text)-over)
+		}
+	}
+	return text, nil
+}
+
+// truncate cuts s to at most n bytes without splitting a rune.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	if n <= 0 {
+		return ""
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// writeNonblock writes b to f once, returning EAGAIN rather than waiting
+// if f is full.
+func writeNonblock(f *os.File, b []byte) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var werr error
+	err = rc.Write(func(fd uintptr) bool {
+		_, werr = syscall.Write(int(fd), b)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return werr
+}
+
+func (c *Client) Stop() error {
+	if c.pipe != nil {
+		return c.pipe.Close()
+	}
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "bar error: "+format, v...)
+}
@@ -0,0 +1,191 @@
+package bar
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func TestBarFormats(t *testing.T) {
+	playing := mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: "title", Artist: "artist", Album: "album"},
+	}
+	paused := playing
+	paused.State = mstatus.StatePaused
+	stopped := mstatus.Status{State: mstatus.StateStopped}
+
+	tests := map[string]struct {
+		format string
+		want   string
+	}{
+		formatText: {
+			want: "artist - title\n\n",
+		},
+		formatWaybar: {
+			want: `{"text":"artist - title","tooltip":"title\nartist\nalbum","class":"playing","alt":"playing"}` + "\n" +
+				`{"text":"artist - title","tooltip":"title\nartist\nalbum","class":"paused","alt":"paused"}` + "\n" +
+				`{"text":"","class":"stopped","alt":"stopped"}` + "\n",
+		},
+		formatI3bar: {
+			want: `{"version":1}` + "\n[\n" +
+				`[{"name":"music-status","full_text":"artist - title"}],` + "\n" +
+				`[{"name":"music-status","full_text":""}],` + "\n",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := &Client{
+				format: name,
+				out:    &buf,
+				log:    mstatus.Logger(t.Log),
+			}
+			var err error
+			if c.text, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+				t.Fatal(err)
+			}
+			if c.tooltip, err = mstatus.NewTemplate("tooltip", defaultTooltip); err != nil {
+				t.Fatal(err)
+			}
+
+			ch := make(chan mstatus.Status)
+			go func() {
+				// Repeated statuses should not write a line
+				ch <- playing
+				ch <- playing
+				ch <- paused
+				ch <- stopped
+				close(ch)
+			}()
+			c.Start(ch)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("\ngot  %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBarLongLine(t *testing.T) {
+	// Quotes are escaped in json so lengthen the line
+	long := strings.Repeat(`é"`, 3000)
+	s := mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: long, Artist: long},
+	}
+	for _, format := range []string{formatText, formatWaybar, formatI3bar} {
+		t.Run(format, func(t *testing.T) {
+			c := &Client{format: format}
+			var err error
+			if c.text, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+				t.Fatal(err)
+			}
+			if c.tooltip, err = mstatus.NewTemplate("tooltip", defaultTooltip); err != nil {
+				t.Fatal(err)
+			}
+			line, err := c.line(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(line) > maxLine {
+				t.Errorf("got %d bytes, want at most %d", len(line), maxLine)
+			}
+			if !utf8.ValidString(line) {
+				t.Errorf("split rune in %q", line)
+			}
+			if format != formatText && !json.Valid([]byte(strings.TrimSuffix(line, ","))) {
+				t.Errorf("invalid json %q", line)
+			}
+		})
+	}
+}
+
+func newTestClient(t *testing.T, output string) *Client {
+	t.Helper()
+	c := &Client{format: formatText, log: mstatus.Logger(t.Log)}
+	var err error
+	if c.text, err = mstatus.NewTemplate("text", "{{.Track.Title}}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.setOutput(output); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func playing(title string) mstatus.Status {
+	return mstatus.Status{State: mstatus.StatePlaying, Track: &mstatus.Track{Title: title}}
+}
+
+func TestBarFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bar")
+	c := newTestClient(t, p)
+
+	ch := make(chan mstatus.Status)
+	go func() {
+		ch <- playing("one")
+		ch <- playing("two")
+		close(ch)
+	}()
+	c.Start(ch)
+
+	// Only the current line is kept
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "two\n" {
+		t.Errorf("got %q, want %q", b, "two\n")
+	}
+}
+
+func TestBarFIFO(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bar.fifo")
+	if err := syscall.Mkfifo(p, 0600); err != nil {
+		t.Skip("mkfifo:", err)
+	}
+	c := newTestClient(t, p)
+	defer c.Stop()
+
+	ch := make(chan mstatus.Status)
+	go c.Start(ch)
+	defer close(ch)
+
+	// Dropped without a reader
+	ch <- playing("before")
+
+	r, err := os.OpenFile(p, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	lines := bufio.NewScanner(r)
+
+	// Repeated after a drop, as the reader is now connected. The next
+	// status is only received once the first is written.
+	ch <- playing("before")
+	ch <- playing("after")
+	if !lines.Scan() || lines.Text() != "before" {
+		t.Fatalf("got %q, %v", lines.Text(), lines.Err())
+	}
+
+	// Does not block when the reader stops reading
+	start := time.Now()
+	for i := 0; i < 10000; i++ {
+		ch <- playing(fmt.Sprintf("%d %0100d", i, 0))
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("blocked for %s", d)
+	}
+}
@@ -0,0 +1,235 @@
+package cmus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const scope = "cmus"
+
+// Client polls cmus with the cmus-remote protocol.
+type Client struct {
+	// Unix socket path, or host:port with a password
+	addr     string
+	password string
+	interval time.Duration
+	timeout  time.Duration
+
+	events chan mstatus.Status
+	log    mstatus.Logger
+	done   chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		interval: time.Second,
+		timeout:  5 * time.Second,
+		events:   make(chan mstatus.Status),
+		log:      func(...interface{}) {},
+		done:     make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	c.addr = sess.ConfigString(scope, "address")
+	if c.addr == "" {
+		c.addr = defaultSocket()
+	}
+	c.password = sess.ConfigString(scope, "password")
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid cmus interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+// defaultSocket is where cmus listens unless --listen is given.
+func defaultSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "cmus-socket")
+	}
+	if dir := os.Getenv("CMUS_HOME"); dir != "" {
+		return filepath.Join(dir, "socket")
+	}
+	dir, _ := os.UserConfigDir()
+	return filepath.Join(dir, "cmus", "socket")
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+func (c *Client) Watch() error {
+	c.log("cmus starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+
+		case <-ticker.C:
+			status := mstatus.Status{
+				State:  mstatus.StateStopped,
+				Player: mstatus.Player{Name: scope},
+			}
+			lines, err := c.query()
+			if err != nil {
+				// Not running
+				c.log("cmus query failed", err)
+				c.events <- status
+				continue
+			}
+			status.State, status.Track = parseStatus(lines)
+			c.events <- status
+		}
+	}
+}
+
+// query runs the status command, returning its lines.
+func (c *Client) query() ([]string, error) {
+	network := "unix"
+	if c.password != "" {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if c.password != "" {
+		if _, err := fmt.Fprintf(conn, "passwd %s\n", c.password); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := fmt.Fprint(conn, "status\n"); err != nil {
+		return nil, err
+	}
+
+	// Each response ends with an empty line
+	var out []string
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			return out, nil
+		}
+		out = append(out, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("incomplete response")
+}
+
+// parseStatus maps the lines of the status command.
+//
+//	status playing
+//	file /music/01.flac
+//	duration 292
+//	position 62
+//	tag artist Eric Clapton
+//	tag musicbrainz_trackid 10aae51f-f253-42c4-8af8-5673da1c98e6
+//	set shuffle false
+func parseStatus(lines []string) (mstatus.State, *mstatus.Track) {
+	var state, file, stream string
+	var duration, position int
+	tags := map[string]string{}
+	for _, line := range lines {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "status":
+			state = value
+		case "file":
+			file = value
+		case "stream":
+			stream = value
+		case "duration":
+			duration, _ = strconv.Atoi(value)
+		case "position":
+			position, _ = strconv.Atoi(value)
+		case "tag":
+			if k, v, ok := strings.Cut(value, " "); ok {
+				tags[k] = v
+			}
+		}
+	}
+
+	switch state {
+	case "playing", "paused":
+	default:
+		return mstatus.StateStopped, nil
+	}
+	if file == "" {
+		return mstatus.StateStopped, nil
+	}
+
+	out := &mstatus.Track{
+		ID:               file,
+		Title:            tags["title"],
+		Artist:           tags["artist"],
+		Album:            tags["album"],
+		AlbumArtist:      tags["albumartist"],
+		TrackNumber:      mstatus.ParseNumber(tags["tracknumber"]),
+		DiscNumber:       mstatus.ParseNumber(tags["discnumber"]),
+		ReleaseDate:      tags["date"],
+		Duration:         time.Duration(duration) * time.Second,
+		Elapsed:          time.Duration(position) * time.Second,
+		MbTrackID:        tags["musicbrainz_trackid"],
+		MbReleaseID:      tags["musicbrainz_albumid"],
+		MbArtistID:       tags["musicbrainz_artistid"],
+		MbReleaseTrackID: tags["musicbrainz_releasetrackid"],
+		MbReleaseGroupID: tags["musicbrainz_releasegroupid"],
+		URI:              file,
+	}
+	// The stream title of internet radio, each is a separate play
+	if stream != "" {
+		out.ID = file + "#" + stream
+	}
+	if out.Title == "" {
+		out.Title = stream
+	}
+	if out.Title == "" {
+		out.Title = filepath.Base(file)
+	}
+	if out.Artist != "" {
+		out.Artists = []string{out.Artist}
+	}
+	if s := tags["genre"]; s != "" {
+		out.Tags = []string{s}
+	}
+	if state == "paused" {
+		return mstatus.StatePaused, out
+	}
+	return mstatus.StatePlaying, out
+}
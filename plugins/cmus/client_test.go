@@ -0,0 +1,152 @@
+package cmus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const statusResponse = `status playing
+file /music/01.flac
+duration 292
+position 62
+tag artist Eric Clapton
+tag album 461 Ocean Boulevard
+tag title Motherless Children
+tag date 1974
+tag genre Rock
+tag discnumber 1
+tag tracknumber 1
+tag albumartist Eric Clapton
+tag musicbrainz_trackid 10aae51f-f253-42c4-8af8-5673da1c98e6
+tag musicbrainz_albumid 2089dcff-a209-49c4-8bbe-d43328c6efed
+set aaa_mode all
+set continue true
+
+`
+
+func TestCmusQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cmus-socket")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			if line != "status\n" {
+				t.Errorf("got command %q", line)
+			}
+			fmt.Fprint(conn, statusResponse)
+			conn.Close()
+		}
+	}()
+
+	c := &Client{
+		addr:     path,
+		interval: 10 * time.Millisecond,
+		timeout:  time.Second,
+		events:   make(chan mstatus.Status),
+		log:      mstatus.Logger(t.Log),
+		done:     make(chan struct{}),
+	}
+	go c.Watch()
+	defer c.Stop()
+
+	got := <-c.events
+	expected := mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: mstatus.Player{Name: "cmus"},
+		Track: &mstatus.Track{
+			ID:          "/music/01.flac",
+			Title:       "Motherless Children",
+			Artist:      "Eric Clapton",
+			Artists:     []string{"Eric Clapton"},
+			Album:       "461 Ocean Boulevard",
+			AlbumArtist: "Eric Clapton",
+			TrackNumber: 1,
+			DiscNumber:  1,
+			ReleaseDate: "1974",
+			Tags:        []string{"Rock"},
+			Duration:    292 * time.Second,
+			Elapsed:     62 * time.Second,
+			MbTrackID:   "10aae51f-f253-42c4-8af8-5673da1c98e6",
+			MbReleaseID: "2089dcff-a209-49c4-8bbe-d43328c6efed",
+			URI:         "/music/01.flac",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	// cmus is not running
+	ln.Close()
+	for i := 0; i < 2; i++ {
+		got = <-c.events
+	}
+	if got.State != mstatus.StateStopped || got.Track != nil {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestCmusParseStatus(t *testing.T) {
+	tests := map[string]struct {
+		lines []string
+		state mstatus.State
+		title string
+		id    string
+	}{
+		"stopped": {
+			lines: []string{"status stopped", "file /music/01.flac", "tag title title"},
+			state: mstatus.StateStopped,
+		},
+		"paused": {
+			lines: []string{"status paused", "file /music/01.flac", "tag title title"},
+			state: mstatus.StatePaused,
+			title: "title",
+		},
+		"stream": {
+			lines: []string{"status playing", "file http://radio.example.com/live", "stream Eric Clapton - Layla"},
+			state: mstatus.StatePlaying,
+			title: "Eric Clapton - Layla",
+			id:    "http://radio.example.com/live#Eric Clapton - Layla",
+		},
+		"untagged": {
+			lines: []string{"status playing", "file /music/01.flac"},
+			state: mstatus.StatePlaying,
+			title: "01.flac",
+			id:    "/music/01.flac",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			state, track := parseStatus(tt.lines)
+			if state != tt.state {
+				t.Errorf("got state %q, want %q", state, tt.state)
+			}
+			if tt.title == "" {
+				if track != nil {
+					t.Errorf("got track %#v", track)
+				}
+				return
+			}
+			if track == nil || track.Title != tt.title {
+				t.Errorf("got track %#v, want title %q", track, tt.title)
+			}
+			if track != nil && tt.id != "" && track.ID != tt.id {
+				t.Errorf("got ID %q, want %q", track.ID, tt.id)
+			}
+		})
+	}
+}
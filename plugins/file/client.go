@@ -0,0 +1,161 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/template"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		log: func(...interface{}) {},
+	})
+}
+
+const (
+	scope           = "file"
+	defaultTemplate = `{{.Track.Artist}} - {{.Track.Title}}`
+)
+
+// Client writes the current track to files for streaming software such as
+// OBS. Files are replaced atomically so readers never see partial content.
+type Client struct {
+	// Paths to write, each optional
+	textPath    string
+	jsonPath    string
+	artworkPath string
+
+	text *template.Template
+	// Text written when stopped
+	placeholder string
+	// Image copied when there is no artwork
+	placeholderArtwork string
+	log                mstatus.Logger
+
+	last map[string]string
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	c.textPath = sess.ConfigString(scope, "text")
+	c.jsonPath = sess.ConfigString(scope, "json")
+	c.artworkPath = sess.ConfigString(scope, "artwork")
+	if c.textPath == "" && c.jsonPath == "" && c.artworkPath == "" {
+		return fmt.Errorf("no files configured")
+	}
+
+	text := defaultTemplate
+	if s := sess.ConfigString(scope, "template"); s != "" {
+		text = s
+	}
+	var err error
+	if c.text, err = mstatus.NewTemplate("text", text); err != nil {
+		return err
+	}
+	c.placeholder = sess.ConfigString(scope, "placeholder")
+	c.placeholderArtwork = sess.ConfigString(scope, "placeholderArtwork")
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	c.last = make(map[string]string)
+	for event := range events {
+		if event.State != mstatus.StatePlaying && event.State != mstatus.StatePaused {
+			event.Track = nil
+		}
+		if err := c.write(event); err != nil {
+			errorf("failed to write: %s\n", err)
+		}
+	}
+}
+
+// write updates each output, a failure does not prevent the others.
+func (c *Client) write(s mstatus.Status) error {
+	return errors.Join(c.writeText(s), c.writeJSON(s), c.writeArtwork(s))
+}
+
+func (c *Client) writeText(s mstatus.Status) error {
+	if c.textPath == "" {
+		return nil
+	}
+	text := c.placeholder
+	if s.Track != nil {
+		var err error
+		if text, err = mstatus.ExecuteTemplate(c.text, s); err != nil {
+			return err
+		}
+	}
+	return c.update(c.textPath, text, func() ([]byte, error) {
+		return []byte(text), nil
+	})
+}
+
+func (c *Client) writeJSON(s mstatus.Status) error {
+	if c.jsonPath == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(mstatus.NewWireStatus(s), "", "  ")
+	if err != nil {
+		return err
+	}
+	return c.update(c.jsonPath, string(b), func() ([]byte, error) {
+		return b, nil
+	})
+}
+
+func (c *Client) writeArtwork(s mstatus.Status) error {
+	if c.artworkPath == "" {
+		return nil
+	}
+	src := c.placeholderArtwork
+	if s.Track != nil && s.Track.ArtworkPath != "" {
+		src = s.Track.ArtworkPath
+	}
+	if src == "" {
+		if c.last[c.artworkPath] != "" {
+			c.last[c.artworkPath] = ""
+			if err := os.Remove(c.artworkPath); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	return c.update(c.artworkPath, src, func() ([]byte, error) {
+		return os.ReadFile(src)
+	})
+}
+
+// update writes a file if key differs from the last write.
+func (c *Client) update(p, key string, data func() ([]byte, error)) error {
+	if v, ok := c.last[p]; ok && v == key {
+		return nil
+	}
+	b, err := data()
+	if err != nil {
+		return err
+	}
+	if err := mstatus.WriteFileAtomic(p, b, 0644); err != nil {
+		return err
+	}
+	c.last[p] = key
+	c.log("file wrote", p)
+	return nil
+}
+
+func (c *Client) Stop() error {
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "file error: "+format, v...)
+}
@@ -0,0 +1,111 @@
+package file
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func TestFileWrite(t *testing.T) {
+	dir := t.TempDir()
+	art := path.Join(dir, "source.png")
+	if err := os.WriteFile(art, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{
+		textPath:    path.Join(dir, "nowplaying.txt"),
+		jsonPath:    path.Join(dir, "nowplaying.json"),
+		artworkPath: path.Join(dir, "cover.png"),
+		placeholder: "nothing playing",
+		log:         mstatus.Logger(t.Log),
+	}
+	var err error
+	if c.text, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(p string) string {
+		t.Helper()
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+
+	ch <- mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: "title", Artist: "artist", Album: "album", ArtworkPath: art},
+	}
+	// Block until the first status has been handled
+	ch <- mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: "title", Artist: "artist", Album: "album", ArtworkPath: art},
+	}
+
+	if got := read(c.textPath); got != "artist - title" {
+		t.Errorf("got %q", got)
+	}
+	var ws mstatus.WireStatus
+	if err := json.Unmarshal([]byte(read(c.jsonPath)), &ws); err != nil {
+		t.Fatal(err)
+	}
+	if ws.State != mstatus.StatePlaying || ws.Track == nil || ws.Track.Album != "album" {
+		t.Errorf("got %#v", ws)
+	}
+	if got := read(c.artworkPath); got != "image" {
+		t.Errorf("got %q", got)
+	}
+
+	ch <- mstatus.Status{State: mstatus.StateStopped}
+	close(ch)
+	<-done
+
+	if got := read(c.textPath); got != "nothing playing" {
+		t.Errorf("got %q", got)
+	}
+	ws = mstatus.WireStatus{}
+	if err := json.Unmarshal([]byte(read(c.jsonPath)), &ws); err != nil {
+		t.Fatal(err)
+	}
+	if ws.State != mstatus.StateStopped || ws.Track != nil {
+		t.Errorf("got %#v", ws)
+	}
+	if _, err := os.Stat(c.artworkPath); !os.IsNotExist(err) {
+		t.Errorf("artwork not removed: %v", err)
+	}
+}
+
+func TestFileWriteError(t *testing.T) {
+	dir := t.TempDir()
+	c := &Client{
+		// The directory does not exist
+		textPath: path.Join(dir, "missing", "nowplaying.txt"),
+		jsonPath: path.Join(dir, "nowplaying.json"),
+		last:     make(map[string]string),
+		log:      mstatus.Logger(t.Log),
+	}
+	var err error
+	if c.text, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.write(mstatus.Status{State: mstatus.StateStopped}); err == nil {
+		t.Error("expected an error")
+	}
+	// The other outputs are still written
+	if _, err := os.Stat(c.jsonPath); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,286 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		timeout: defaultTimeout,
+		rule:    mstatus.DefaultListenRule,
+		log:     func(...interface{}) {},
+	})
+}
+
+const (
+	scope          = "hook"
+	defaultTimeout = 10 * time.Second
+)
+
+// Event names passed to the command.
+const (
+	eventTrack  = "track"
+	eventState  = "state"
+	eventListen = "listen"
+)
+
+// Client runs a command when the track or state changes and when a listen
+// completes. Invocations are serialised, if the command is still running
+// only the latest change is kept for the next run.
+type Client struct {
+	command string
+	timeout time.Duration
+	rule    mstatus.ListenRule
+	log     mstatus.Logger
+
+	mu       sync.Mutex
+	pending  []invocation
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+// invocation is a single run of the command.
+type invocation struct {
+	Event  string              `json:"event"`
+	Status *mstatus.WireStatus `json:"status"`
+	Listen *listen             `json:"listen,omitempty"`
+}
+
+type listen struct {
+	StartedAt  int64 `json:"started_at"`
+	ListenedMs int64 `json:"listened_ms"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	c.command = sess.ConfigString(scope, "command")
+	if c.command == "" {
+		return fmt.Errorf("missing hook command")
+	}
+	if s := sess.ConfigString(scope, "timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.timeout = d
+	}
+	rule, err := mstatus.LoadListenRule(sess, scope)
+	if err != nil {
+		return err
+	}
+	c.rule = rule
+
+	c.wake = make(chan struct{}, 1)
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.run()
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	tracker := mstatus.NewListenTracker(c.rule)
+	var last mstatus.Status
+	for event := range events {
+		for _, l := range tracker.Update(event) {
+			if l.Type == mstatus.ListenCompleted {
+				c.enqueueListen(event, l)
+			}
+		}
+		switch {
+		case trackChanged(last, event):
+			c.enqueue(invocation{Event: eventTrack, Status: mstatus.NewWireStatus(event)})
+		case last.State != event.State:
+			c.enqueue(invocation{Event: eventState, Status: mstatus.NewWireStatus(event)})
+		}
+		last = event
+	}
+	for _, l := range tracker.Flush() {
+		c.enqueueListen(last, l)
+	}
+}
+
+func trackChanged(a, b mstatus.Status) bool {
+	if a.Track == nil || b.Track == nil {
+		return a.Track != b.Track && b.Track != nil
+	}
+	return a.Track.ID != b.Track.ID || a.Track.Title != b.Track.Title || a.Track.Artist != b.Track.Artist
+}
+
+func (c *Client) enqueueListen(s mstatus.Status, l mstatus.Listen) {
+	s.Track = &l.Track
+	c.enqueue(invocation{
+		Event:  eventListen,
+		Status: mstatus.NewWireStatus(s),
+		Listen: &listen{
+			StartedAt:  l.StartedAt.Unix(),
+			ListenedMs: l.Listened.Milliseconds(),
+		},
+	})
+}
+
+// enqueue adds an invocation, replacing any pending track or state change
+// which would be out of date. Completed listens are never dropped.
+func (c *Client) enqueue(inv invocation) {
+	c.mu.Lock()
+	if inv.Event != eventListen {
+		kept := c.pending[:0]
+		for _, p := range c.pending {
+			if p.Event == eventListen {
+				kept = append(kept, p)
+			}
+		}
+		c.pending = kept
+	}
+	c.pending = append(c.pending, inv)
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	for {
+		c.mu.Lock()
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			select {
+			case <-c.stop:
+				// Events have ended, return once the queue is empty
+				c.mu.Lock()
+				empty := len(c.pending) == 0
+				c.mu.Unlock()
+				if empty {
+					return
+				}
+			case <-c.wake:
+			}
+			continue
+		}
+		inv := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+
+		if err := c.invoke(inv); err != nil {
+			errorf("failed to run hook: %s\n", err)
+		}
+	}
+}
+
+func (c *Client) invoke(inv invocation) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c.command)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(), environ(inv)...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// Do not wait on output held open by background children
+	cmd.WaitDelay = time.Second
+
+	c.log("hook running", inv.Event)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s", c.timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// environ returns the MSTATUS_* variables for an invocation.
+func environ(inv invocation) []string {
+	s := inv.Status
+	env := map[string]string{
+		"EVENT":  inv.Event,
+		"STATE":  string(s.State),
+		"PLAYER": s.Player.Name,
+		"ERROR":  s.Error,
+	}
+	if t := s.Track; t != nil {
+		env["ID"] = t.ID
+		env["TITLE"] = t.Title
+		env["ARTIST"] = t.Artist
+		env["ARTISTS"] = strings.Join(t.Artists, "; ")
+		env["ALBUM"] = t.Album
+		env["ALBUM_ARTIST"] = t.AlbumArtist
+		env["TRACK_NUMBER"] = number(t.TrackNumber)
+		env["DISC_NUMBER"] = number(t.DiscNumber)
+		env["DATE"] = t.ReleaseDate
+		env["TAGS"] = strings.Join(t.Tags, "; ")
+		env["DURATION"] = seconds(t.DurationMs)
+		env["ELAPSED"] = seconds(t.ElapsedMs)
+		env["MB_ARTIST_ID"] = t.MbArtistID
+		env["MB_TRACK_ID"] = t.MbTrackID
+		env["MB_RELEASE_ID"] = t.MbReleaseID
+		env["ISRC"] = t.ISRC
+		env["ARTWORK_URL"] = t.ArtworkURL
+		env["ARTWORK_PATH"] = t.ArtworkPath
+		env["URI"] = t.URI
+	}
+	if l := inv.Listen; l != nil {
+		env["STARTED_AT"] = strconv.FormatInt(l.StartedAt, 10)
+		env["LISTENED"] = seconds(l.ListenedMs)
+	}
+
+	var out []string
+	for k, v := range env {
+		out = append(out, "MSTATUS_"+k+"="+v)
+	}
+	return out
+}
+
+func number(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+func seconds(ms int64) string {
+	return strconv.FormatInt(ms/1000, 10)
+}
+
+// Stop runs any pending hooks, such as listens flushed at the end of the
+// events, waiting up to the timeout for them to finish.
+func (c *Client) Stop() error {
+	if c.done == nil {
+		return nil
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+	select {
+	case <-c.done:
+	case <-time.After(c.timeout):
+	}
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "hook error: "+format, v...)
+}
@@ -0,0 +1,151 @@
+package hook
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func newTestClient(t *testing.T, command string) *Client {
+	t.Helper()
+	c := &Client{
+		command: command,
+		timeout: 5 * time.Second,
+		rule:    mstatus.DefaultListenRule,
+		log:     mstatus.Logger(t.Log),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// waitFor polls the file at p until it contains s.
+func waitFor(t *testing.T, p, s string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(p)
+		if strings.Contains(string(b), s) {
+			return string(b)
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q in %q", s, b)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestHookEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestClient(t, `env > "`+dir+`/env.tmp"; cat > "`+dir+`/stdin"; mv "`+dir+`/env.tmp" "`+dir+`/env"`)
+	defer c.Stop()
+
+	ch := make(chan mstatus.Status)
+	go c.Start(ch)
+	ch <- mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: mstatus.Player{Name: "mpd"},
+		Track: &mstatus.Track{
+			ID:       "id",
+			Title:    "title",
+			Artist:   "artist",
+			Album:    "album",
+			Duration: 90 * time.Second,
+			Elapsed:  time.Minute,
+		},
+	}
+	close(ch)
+
+	env := waitFor(t, path.Join(dir, "env"), "MSTATUS_EVENT")
+	for _, want := range []string{
+		"MSTATUS_EVENT=track",
+		"MSTATUS_STATE=playing",
+		"MSTATUS_PLAYER=mpd",
+		"MSTATUS_TITLE=title",
+		"MSTATUS_ARTIST=artist",
+		"MSTATUS_ALBUM=album",
+		"MSTATUS_DURATION=90",
+		"MSTATUS_ELAPSED=60",
+	} {
+		if !strings.Contains(env, want+"\n") {
+			t.Errorf("missing %q", want)
+		}
+	}
+
+	b, err := os.ReadFile(path.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inv invocation
+	if err := json.Unmarshal(b, &inv); err != nil {
+		t.Fatal(err)
+	}
+	if inv.Event != eventTrack || inv.Status.Track.Title != "title" {
+		t.Errorf("got %#v", inv)
+	}
+}
+
+func TestHookSerialised(t *testing.T) {
+	log := path.Join(t.TempDir(), "log")
+	c := newTestClient(t, `echo "$MSTATUS_TITLE" >> "`+log+`"; sleep 0.2`)
+	defer c.Stop()
+
+	ch := make(chan mstatus.Status)
+	go c.Start(ch)
+	send := func(title string) {
+		ch <- mstatus.Status{
+			State: mstatus.StatePlaying,
+			Track: &mstatus.Track{ID: title, Title: title},
+		}
+	}
+
+	send("a")
+	waitFor(t, log, "a")
+	// These arrive while the first hook is running and only the latest
+	// should be run
+	for _, s := range []string{"b", "c", "d", "e"} {
+		send(s)
+	}
+	got := waitFor(t, log, "e")
+	if got != "a\ne\n" {
+		t.Errorf("got %q, want %q", got, "a\ne\n")
+	}
+	close(ch)
+}
+
+func TestHookStopDrains(t *testing.T) {
+	log := path.Join(t.TempDir(), "log")
+	c := newTestClient(t, `echo "$MSTATUS_EVENT" >> "`+log+`"; sleep 0.1`)
+	c.rule = mstatus.ListenRule{MaxThreshold: time.Millisecond}
+
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		ch <- mstatus.Status{
+			State: mstatus.StatePlaying,
+			Track: &mstatus.Track{ID: "a", Title: "a"},
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(ch)
+	<-done
+
+	// The pending listen must run before Stop returns
+	c.Stop()
+	b, _ := os.ReadFile(log)
+	if got := string(b); !strings.Contains(got, "listen\n") {
+		t.Errorf("got %q, want a listen", got)
+	}
+}
@@ -0,0 +1,423 @@
+package jellyfin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const (
+	scope = "jellyfin"
+	// Delay before reconnecting the websocket, sessions are polled meanwhile
+	reconnectInterval = 30 * time.Second
+	// Interval requested for websocket session updates
+	sessionsInterval = "0,1500"
+	// Sessions active within this time are polled
+	activeWithin = "960"
+)
+
+// Client follows a user's session on a Jellyfin or Emby server.
+type Client struct {
+	apiURL     string
+	token      string
+	user       string
+	emby       bool
+	interval   time.Duration
+	httpClient *http.Client
+
+	events chan mstatus.Status
+	log    mstatus.Logger
+	done   chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		interval:   5 * time.Second,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan mstatus.Status),
+		log:        func(...interface{}) {},
+		done:       make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing jellyfin url")
+	}
+	c.token = sess.ConfigString(scope, "token")
+	if c.token == "" {
+		return fmt.Errorf("missing jellyfin token")
+	}
+	// API keys are not tied to a user
+	c.user = sess.ConfigString(scope, "user")
+	if c.user == "" {
+		return fmt.Errorf("missing jellyfin user")
+	}
+	c.emby = sess.ConfigBool(scope, "emby")
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid jellyfin interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+// Watch follows sessions over the websocket, polling while it is
+// unavailable.
+func (c *Client) Watch() error {
+	c.log("jellyfin starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	var reconnect <-chan time.Time
+	var updates <-chan []session
+	connect := func() {
+		ch, err := c.subscribe()
+		if err != nil {
+			c.log("jellyfin websocket failed, polling", err)
+			reconnect = time.After(reconnectInterval)
+			return
+		}
+		c.log("jellyfin websocket connected")
+		updates = ch
+	}
+	connect()
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+
+		case <-reconnect:
+			connect()
+
+		case sessions, ok := <-updates:
+			if !ok {
+				c.log("jellyfin websocket closed, polling")
+				updates = nil
+				reconnect = time.After(reconnectInterval)
+				continue
+			}
+			c.events <- c.newStatus(sessions)
+
+		case <-ticker.C:
+			if updates != nil {
+				continue
+			}
+			sessions, err := c.sessions()
+			if err != nil {
+				errorf("failed to get sessions: %s\n", err)
+				continue
+			}
+			c.events <- c.newStatus(sessions)
+		}
+	}
+}
+
+// session is a client session.
+type session struct {
+	ID                 string `json:"Id"`
+	UserID             string `json:"UserId"`
+	UserName           string `json:"UserName"`
+	Client             string `json:"Client"`
+	ApplicationVersion string `json:"ApplicationVersion"`
+	NowPlayingItem     *item  `json:"NowPlayingItem"`
+	PlayState          struct {
+		PositionTicks int64 `json:"PositionTicks"`
+		IsPaused      bool  `json:"IsPaused"`
+	} `json:"PlayState"`
+}
+
+// item is a library item.
+type item struct {
+	ID                string            `json:"Id"`
+	Name              string            `json:"Name"`
+	Type              string            `json:"Type"`
+	Album             string            `json:"Album"`
+	AlbumID           string            `json:"AlbumId"`
+	AlbumArtist       string            `json:"AlbumArtist"`
+	Artists           []string          `json:"Artists"`
+	IndexNumber       int               `json:"IndexNumber"`
+	ParentIndexNumber int               `json:"ParentIndexNumber"`
+	ProductionYear    int               `json:"ProductionYear"`
+	PremiereDate      string            `json:"PremiereDate"`
+	RunTimeTicks      int64             `json:"RunTimeTicks"`
+	Genres            []string          `json:"Genres"`
+	Path              string            `json:"Path"`
+	ProviderIDs       map[string]string `json:"ProviderIds"`
+	ImageTags         map[string]string `json:"ImageTags"`
+	AlbumImageTag     string            `json:"AlbumPrimaryImageTag"`
+}
+
+// message is sent and received over the websocket.
+type message struct {
+	MessageType string          `json:"MessageType"`
+	Data        json.RawMessage `json:"Data,omitempty"`
+}
+
+// subscribe connects the websocket and requests session updates, which
+// are sent on the channel until the connection fails.
+func (c *Client) subscribe() (<-chan []session, error) {
+	u, err := url.Parse(c.apiURL)
+	if err != nil {
+		return nil, err
+	}
+	origin := u.String()
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	default:
+		u.Scheme = "ws"
+	}
+	if c.emby {
+		u = u.JoinPath("embywebsocket")
+	} else {
+		u = u.JoinPath("socket")
+	}
+	u.RawQuery = url.Values{
+		"api_key":  {c.token},
+		"deviceId": {deviceID()},
+	}.Encode()
+
+	cfg, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Dialer = &net.Dialer{Timeout: c.httpClient.Timeout}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	start := message{MessageType: "SessionsStart"}
+	start.Data, _ = json.Marshal(sessionsInterval)
+	if err := websocket.JSON.Send(ws, start); err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	out := make(chan []session)
+	closed := make(chan struct{})
+	go func() {
+		select {
+		case <-c.done:
+		case <-closed:
+		}
+		ws.Close()
+	}()
+	go func() {
+		var keepAlive *time.Ticker
+		defer func() {
+			if keepAlive != nil {
+				keepAlive.Stop()
+			}
+			close(closed)
+			close(out)
+		}()
+		for {
+			var msg message
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			switch msg.MessageType {
+			case "Sessions":
+				var sessions []session
+				if err := json.Unmarshal(msg.Data, &sessions); err != nil {
+					c.log("jellyfin invalid sessions", err)
+					continue
+				}
+				select {
+				case out <- sessions:
+				case <-c.done:
+					return
+				}
+			case "ForceKeepAlive":
+				// The server closes connections that are quiet for this
+				// many seconds
+				var secs int
+				if err := json.Unmarshal(msg.Data, &secs); err != nil || secs <= 0 || keepAlive != nil {
+					continue
+				}
+				keepAlive = time.NewTicker(time.Duration(secs) * time.Second / 2)
+				go func(ticks <-chan time.Time) {
+					for {
+						select {
+						case <-closed:
+							return
+						case <-ticks:
+							websocket.JSON.Send(ws, message{MessageType: "KeepAlive"})
+						}
+					}
+				}(keepAlive.C)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// sessions polls the active sessions.
+func (c *Client) sessions() ([]session, error) {
+	u, err := url.Parse(c.apiURL)
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath("Sessions")
+	u.RawQuery = url.Values{"activeWithinSeconds": {activeWithin}}.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", c.token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("request failed: %d %q", resp.StatusCode, string(body))
+	}
+	var out []session
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	return out, err
+}
+
+// newStatus maps the user's audio session, preferring one that is not
+// paused.
+func (c *Client) newStatus(sessions []session) mstatus.Status {
+	var current *session
+	for i, s := range sessions {
+		if !strings.EqualFold(s.UserName, c.user) && s.UserID != c.user {
+			continue
+		}
+		if s.NowPlayingItem == nil || s.NowPlayingItem.Type != "Audio" {
+			continue
+		}
+		if current == nil || (current.PlayState.IsPaused && !s.PlayState.IsPaused) {
+			current = &sessions[i]
+		}
+	}
+	if current == nil {
+		return mstatus.Status{
+			State:  mstatus.StateStopped,
+			Player: mstatus.Player{Name: scope},
+		}
+	}
+	out := mstatus.Status{
+		State: mstatus.StatePlaying,
+		Player: mstatus.Player{
+			Name:    current.Client,
+			Version: current.ApplicationVersion,
+		},
+		Track: c.newTrack(current.NowPlayingItem, current.PlayState.PositionTicks),
+	}
+	if current.PlayState.IsPaused {
+		out.State = mstatus.StatePaused
+	}
+	return out
+}
+
+func (c *Client) newTrack(it *item, position int64) *mstatus.Track {
+	ids := it.ProviderIDs
+	out := &mstatus.Track{
+		ID:          it.ID,
+		Title:       it.Name,
+		Artists:     it.Artists,
+		Album:       it.Album,
+		AlbumArtist: it.AlbumArtist,
+		TrackNumber: it.IndexNumber,
+		DiscNumber:  it.ParentIndexNumber,
+		Tags:        it.Genres,
+		Duration:    ticks(it.RunTimeTicks),
+		Elapsed:     ticks(position),
+		MbArtistID:  ids["MusicBrainzArtist"],
+		// Jellyfin's track ID is the release track
+		MbTrackID:        ids["MusicBrainzRecording"],
+		MbReleaseTrackID: ids["MusicBrainzTrack"],
+		MbReleaseID:      ids["MusicBrainzAlbum"],
+		MbReleaseGroupID: ids["MusicBrainzReleaseGroup"],
+		ISRC:             ids["ISRC"],
+		URI:              it.Path,
+	}
+	if len(it.Artists) > 0 {
+		out.Artist = it.Artists[0]
+	}
+	if out.MbArtistID == "" {
+		out.MbArtistID = ids["MusicBrainzAlbumArtist"]
+	}
+	switch {
+	case len(it.PremiereDate) >= 10:
+		out.ReleaseDate = it.PremiereDate[:10]
+	case it.ProductionYear > 0:
+		out.ReleaseDate = fmt.Sprint(it.ProductionYear)
+	}
+	// Images can be fetched without authentication
+	switch {
+	case it.ImageTags["Primary"] != "":
+		out.ArtworkURL = c.imageURL(it.ID)
+	case it.AlbumImageTag != "" && it.AlbumID != "":
+		out.ArtworkURL = c.imageURL(it.AlbumID)
+	}
+	return out
+}
+
+func (c *Client) imageURL(id string) string {
+	u, err := url.JoinPath(c.apiURL, "Items", id, "Images", "Primary")
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+// ticks converts 100ns ticks to a duration.
+func ticks(n int64) time.Duration {
+	return time.Duration(n) * 100
+}
+
+// deviceID identifies this client to the server.
+func deviceID() string {
+	host, _ := os.Hostname()
+	return mstatus.ClientName + "-" + host
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "jellyfin error: "+format, v...)
+}
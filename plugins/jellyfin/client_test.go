@@ -0,0 +1,129 @@
+package jellyfin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const sessionsResponse = `[
+{"Id":"s0","UserId":"u2","UserName":"other","Client":"Jellyfin Web","NowPlayingItem":{"Id":"x","Name":"other","Type":"Audio"},"PlayState":{}},
+{"Id":"s1","UserId":"u1","UserName":"User","Client":"Finamp","ApplicationVersion":"0.9.2","NowPlayingItem":{"Id":"v","Name":"video","Type":"Episode"},"PlayState":{}},
+{"Id":"s2","UserId":"u1","UserName":"User","Client":"Feishin","ApplicationVersion":"0.5.0","PlayState":{"PositionTicks":600000000,"IsPaused":false},
+ "NowPlayingItem":{"Id":"i1","Name":"Motherless Children","Type":"Audio","Album":"461 Ocean Boulevard","AlbumId":"a1","AlbumArtist":"Eric Clapton","Artists":["Eric Clapton"],
+  "IndexNumber":1,"ParentIndexNumber":1,"ProductionYear":1974,"PremiereDate":"1974-07-01T00:00:00.0000000Z","RunTimeTicks":2920000000,"Genres":["Rock"],"Path":"/music/01.flac",
+  "ProviderIds":{"MusicBrainzArtist":"618b6900-0618-4f1e-b835-bccb17f84294","MusicBrainzAlbum":"2089dcff-a209-49c4-8bbe-d43328c6efed","MusicBrainzTrack":"8516da10-ebe3-47c4-b33b-501e6250cbce","MusicBrainzRecording":"10aae51f-f253-42c4-8af8-5673da1c98e6","MusicBrainzReleaseGroup":"rg"},
+  "ImageTags":{},"AlbumPrimaryImageTag":"tag"}}
+]`
+
+func TestJellyfinStatus(t *testing.T) {
+	var sessions []session
+	if err := json.Unmarshal([]byte(sessionsResponse), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{apiURL: "https://jellyfin.example.com", user: "user"}
+	got := c.newStatus(sessions)
+	expected := mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: mstatus.Player{Name: "Feishin", Version: "0.5.0"},
+		Track: &mstatus.Track{
+			ID:               "i1",
+			Title:            "Motherless Children",
+			Artist:           "Eric Clapton",
+			Artists:          []string{"Eric Clapton"},
+			Album:            "461 Ocean Boulevard",
+			AlbumArtist:      "Eric Clapton",
+			TrackNumber:      1,
+			DiscNumber:       1,
+			ReleaseDate:      "1974-07-01",
+			Tags:             []string{"Rock"},
+			Duration:         292 * time.Second,
+			Elapsed:          time.Minute,
+			MbArtistID:       "618b6900-0618-4f1e-b835-bccb17f84294",
+			MbTrackID:        "10aae51f-f253-42c4-8af8-5673da1c98e6",
+			MbReleaseID:      "2089dcff-a209-49c4-8bbe-d43328c6efed",
+			MbReleaseTrackID: "8516da10-ebe3-47c4-b33b-501e6250cbce",
+			MbReleaseGroupID: "rg",
+			ArtworkURL:       "https://jellyfin.example.com/Items/a1/Images/Primary",
+			URI:              "/music/01.flac",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	sessions[2].PlayState.IsPaused = true
+	if got := c.newStatus(sessions); got.State != mstatus.StatePaused || got.Track == nil {
+		t.Errorf("got %#v", got)
+	}
+
+	// Matched by ID as well as name
+	c.user = "u2"
+	if got := c.newStatus(sessions); got.Track == nil || got.Track.ID != "x" {
+		t.Errorf("got %#v", got)
+	}
+	c.user = "nobody"
+	if got := c.newStatus(sessions); got.State != mstatus.StateStopped || got.Track != nil {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestJellyfinWatch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/socket", websocket.Handler(func(ws *websocket.Conn) {
+		if ws.Request().URL.Query().Get("api_key") != "token" {
+			t.Error("missing api_key")
+			return
+		}
+		var msg message
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Error(err)
+			return
+		}
+		if msg.MessageType != "SessionsStart" {
+			t.Errorf("got message %q", msg.MessageType)
+		}
+		fmt.Fprint(ws, `{"MessageType":"ForceKeepAlive","Data":60}`)
+		fmt.Fprintf(ws, `{"MessageType":"Sessions","Data":%s}`, sessionsResponse)
+		// Closing falls back to polling
+	}))
+	mux.HandleFunc("/Sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Emby-Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `[]`)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL,
+		token:      "token",
+		user:       "user",
+		interval:   10 * time.Millisecond,
+		httpClient: ts.Client(),
+		events:     make(chan mstatus.Status),
+		log:        mstatus.Logger(t.Log),
+		done:       make(chan struct{}),
+	}
+	go c.Watch()
+	defer c.Stop()
+
+	s := <-c.events
+	if s.State != mstatus.StatePlaying || s.Track == nil || s.Track.ID != "i1" {
+		t.Fatalf("got %#v", s)
+	}
+	s = <-c.events
+	if s.State != mstatus.StateStopped || s.Track != nil {
+		t.Errorf("got %#v", s)
+	}
+}
@@ -0,0 +1,348 @@
+package kodi
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const scope = "kodi"
+
+// playerNotifications are the notifications that change playback.
+var playerNotifications = map[string]bool{
+	"Player.OnPlay":         true,
+	"Player.OnAVStart":      true,
+	"Player.OnResume":       true,
+	"Player.OnPause":        true,
+	"Player.OnStop":         true,
+	"Player.OnSeek":         true,
+	"Player.OnSpeedChanged": true,
+}
+
+// itemProperties are requested for the playing item.
+var itemProperties = []string{
+	"title", "artist", "albumartist", "album", "track", "disc", "year",
+	"genre", "duration", "file", "musicbrainztrackid", "musicbrainzalbumid",
+	"musicbrainzartistid", "musicbrainzalbumartistid",
+}
+
+// Client follows Kodi's audio player with JSON-RPC notifications.
+type Client struct {
+	addr      string
+	websocket bool
+	interval  time.Duration
+	timeout   time.Duration
+	version   string
+
+	events chan mstatus.Status
+	log    mstatus.Logger
+	done   chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		addr:     "localhost:9090",
+		interval: 5 * time.Second,
+		timeout:  10 * time.Second,
+		events:   make(chan mstatus.Status),
+		log:      func(...interface{}) {},
+		done:     make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	host := sess.ConfigString(scope, "host")
+	if host == "" {
+		host = "localhost"
+	}
+	port := sess.ConfigInt(scope, "port")
+	if port == 0 {
+		port = 9090
+	}
+	c.addr = net.JoinHostPort(host, fmt.Sprint(port))
+	c.websocket = sess.ConfigBool(scope, "websocket")
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid kodi interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+// Watch refreshes the status on player notifications and periodically to
+// update the elapsed time. It reconnects on the same interval.
+func (c *Client) Watch() error {
+	c.log("kodi starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	var conn *rpcConn
+	connect := func() {
+		var err error
+		if conn, err = c.dial(); err != nil {
+			c.log("kodi failed to connect", err)
+			conn = nil
+			return
+		}
+		c.log("kodi connected", c.addr)
+		c.refresh(conn)
+	}
+	connect()
+
+	for {
+		// Nil channels block while disconnected
+		var changed, closed <-chan struct{}
+		if conn != nil {
+			changed, closed = conn.changed, conn.closed
+		}
+
+		select {
+		case <-c.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return nil
+
+		case <-closed:
+			c.log("kodi disconnected")
+			conn.Close()
+			conn = nil
+			c.events <- mstatus.Status{
+				State:  mstatus.StateStopped,
+				Player: c.player(),
+			}
+
+		case <-changed:
+			c.refresh(conn)
+
+		case <-ticker.C:
+			if conn == nil {
+				connect()
+				continue
+			}
+			c.refresh(conn)
+		}
+	}
+}
+
+func (c *Client) dial() (*rpcConn, error) {
+	if c.websocket {
+		origin := "http://" + c.addr
+		cfg, err := websocket.NewConfig("ws://"+c.addr+"/jsonrpc", origin)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Dialer = &net.Dialer{Timeout: c.timeout}
+		ws, err := websocket.DialConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return c.setup(newRPCConn(ws, c.timeout))
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return c.setup(newRPCConn(nc, c.timeout))
+}
+
+// setup reads the version of a new connection.
+func (c *Client) setup(conn *rpcConn) (*rpcConn, error) {
+	var r struct {
+		Version struct {
+			Major int    `json:"major"`
+			Minor int    `json:"minor"`
+			Tag   string `json:"tag"`
+		} `json:"version"`
+	}
+	if err := conn.call("Application.GetProperties", map[string]interface{}{
+		"properties": []string{"version"},
+	}, &r); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.version = fmt.Sprintf("%d.%d", r.Version.Major, r.Version.Minor)
+	if r.Version.Tag != "" && r.Version.Tag != "stable" {
+		c.version += "-" + r.Version.Tag
+	}
+	return conn, nil
+}
+
+func (c *Client) player() mstatus.Player {
+	return mstatus.Player{Name: scope, Version: c.version}
+}
+
+func (c *Client) refresh(conn *rpcConn) {
+	status, err := c.fetchStatus(conn)
+	if err != nil {
+		errorf("failed to get status: %s\n", err)
+		return
+	}
+	c.events <- status
+}
+
+// item is an audio item from Player.GetItem.
+type item struct {
+	ID                       int      `json:"id"`
+	Type                     string   `json:"type"`
+	Label                    string   `json:"label"`
+	Title                    string   `json:"title"`
+	Artist                   []string `json:"artist"`
+	AlbumArtist              []string `json:"albumartist"`
+	Album                    string   `json:"album"`
+	Track                    int      `json:"track"`
+	Disc                     int      `json:"disc"`
+	Year                     int      `json:"year"`
+	Genre                    []string `json:"genre"`
+	Duration                 int      `json:"duration"`
+	File                     string   `json:"file"`
+	MusicBrainzTrackID       string   `json:"musicbrainztrackid"`
+	MusicBrainzAlbumID       string   `json:"musicbrainzalbumid"`
+	MusicBrainzArtistID      []string `json:"musicbrainzartistid"`
+	MusicBrainzAlbumArtistID []string `json:"musicbrainzalbumartistid"`
+}
+
+// globalTime is a time of the form used by Player.GetProperties.
+type globalTime struct {
+	Hours        int `json:"hours"`
+	Minutes      int `json:"minutes"`
+	Seconds      int `json:"seconds"`
+	Milliseconds int `json:"milliseconds"`
+}
+
+func (t globalTime) Duration() time.Duration {
+	return time.Duration(t.Hours)*time.Hour +
+		time.Duration(t.Minutes)*time.Minute +
+		time.Duration(t.Seconds)*time.Second +
+		time.Duration(t.Milliseconds)*time.Millisecond
+}
+
+// fetchStatus reads the state of the audio player, if any.
+func (c *Client) fetchStatus(conn *rpcConn) (mstatus.Status, error) {
+	out := mstatus.Status{
+		State:  mstatus.StateStopped,
+		Player: c.player(),
+	}
+	var players []struct {
+		PlayerID int    `json:"playerid"`
+		Type     string `json:"type"`
+	}
+	if err := conn.call("Player.GetActivePlayers", nil, &players); err != nil {
+		return out, err
+	}
+	playerID := -1
+	for _, p := range players {
+		if p.Type == "audio" {
+			playerID = p.PlayerID
+			break
+		}
+	}
+	if playerID < 0 {
+		return out, nil
+	}
+
+	var props struct {
+		Time      globalTime `json:"time"`
+		TotalTime globalTime `json:"totaltime"`
+		Speed     int        `json:"speed"`
+	}
+	if err := conn.call("Player.GetProperties", map[string]interface{}{
+		"playerid":   playerID,
+		"properties": []string{"time", "totaltime", "speed"},
+	}, &props); err != nil {
+		return out, err
+	}
+	var r struct {
+		Item item `json:"item"`
+	}
+	if err := conn.call("Player.GetItem", map[string]interface{}{
+		"playerid":   playerID,
+		"properties": itemProperties,
+	}, &r); err != nil {
+		return out, err
+	}
+
+	out.State = mstatus.StatePlaying
+	if props.Speed == 0 {
+		out.State = mstatus.StatePaused
+	}
+	out.Track = newTrack(r.Item)
+	out.Track.Elapsed = props.Time.Duration()
+	if d := props.TotalTime.Duration(); d > 0 {
+		out.Track.Duration = d
+	}
+	return out, nil
+}
+
+func newTrack(it item) *mstatus.Track {
+	out := &mstatus.Track{
+		Title:       it.Title,
+		Artists:     it.Artist,
+		Album:       it.Album,
+		TrackNumber: it.Track,
+		DiscNumber:  it.Disc,
+		Tags:        it.Genre,
+		Duration:    time.Duration(it.Duration) * time.Second,
+		MbTrackID:   it.MusicBrainzTrackID,
+		MbReleaseID: it.MusicBrainzAlbumID,
+		URI:         it.File,
+	}
+	// Streams without tags only have a label
+	if out.Title == "" {
+		out.Title = it.Label
+	}
+	// Library items have IDs, files played directly do not. The title is
+	// included so each track of a stream is a separate play.
+	if it.ID > 0 {
+		out.ID = fmt.Sprint(it.ID)
+	} else {
+		out.ID = it.File + "#" + out.Title
+	}
+	if len(it.Artist) > 0 {
+		out.Artist = it.Artist[0]
+	}
+	if len(it.AlbumArtist) > 0 {
+		out.AlbumArtist = it.AlbumArtist[0]
+	}
+	switch {
+	case len(it.MusicBrainzArtistID) > 0:
+		out.MbArtistID = it.MusicBrainzArtistID[0]
+	case len(it.MusicBrainzAlbumArtistID) > 0:
+		out.MbArtistID = it.MusicBrainzAlbumArtistID[0]
+	}
+	if it.Year > 0 {
+		out.ReleaseDate = fmt.Sprint(it.Year)
+	}
+	return out
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "kodi error: "+format, v...)
+}
@@ -0,0 +1,209 @@
+package kodi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const itemResponse = `{"item":{"id":42,"type":"song","label":"Motherless Children","title":"Motherless Children",
+"artist":["Eric Clapton"],"albumartist":["Eric Clapton"],"album":"461 Ocean Boulevard","track":1,"disc":1,"year":1974,
+"genre":["Rock"],"duration":292,"file":"/music/01.flac","musicbrainztrackid":"10aae51f-f253-42c4-8af8-5673da1c98e6",
+"musicbrainzalbumid":"2089dcff-a209-49c4-8bbe-d43328c6efed","musicbrainzartistid":["618b6900-0618-4f1e-b835-bccb17f84294"],
+"musicbrainzalbumartistid":["618b6900-0618-4f1e-b835-bccb17f84294"]}}`
+
+// stub is a Kodi JSON-RPC server.
+type stub struct {
+	t       *testing.T
+	mu      sync.Mutex
+	w       io.Writer
+	playing bool
+	paused  bool
+}
+
+func (s *stub) write(v string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, v)
+}
+
+func (s *stub) serve(rw io.ReadWriter) {
+	s.mu.Lock()
+	s.w = rw
+	s.mu.Unlock()
+	dec := json.NewDecoder(rw)
+	for {
+		var req struct {
+			ID     int             `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		s.mu.Lock()
+		playing, paused := s.playing, s.paused
+		s.mu.Unlock()
+
+		var result string
+		switch req.Method {
+		case "Application.GetProperties":
+			result = `{"version":{"major":21,"minor":1,"revision":"","tag":"stable"}}`
+		case "Player.GetActivePlayers":
+			result = `[{"playerid":1,"playertype":"video","type":"video"}]`
+			if playing {
+				result = `[{"playerid":0,"playertype":"internal","type":"audio"}]`
+			}
+		case "Player.GetProperties":
+			if !strings.Contains(string(req.Params), `"playerid":0`) {
+				s.t.Errorf("got params %s", req.Params)
+			}
+			speed := 1
+			if paused {
+				speed = 0
+			}
+			result = fmt.Sprintf(`{"speed":%d,"time":{"hours":0,"minutes":1,"seconds":2,"milliseconds":500},"totaltime":{"hours":0,"minutes":4,"seconds":52,"milliseconds":0}}`, speed)
+		case "Player.GetItem":
+			result = itemResponse
+		default:
+			s.write(fmt.Sprintf(`{"id":%d,"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found."}}`, req.ID))
+			continue
+		}
+		s.write(fmt.Sprintf(`{"id":%d,"jsonrpc":"2.0","result":%s}`, req.ID, result))
+	}
+}
+
+func (s *stub) set(playing, paused bool, notification string) {
+	s.mu.Lock()
+	s.playing, s.paused = playing, paused
+	s.mu.Unlock()
+	s.write(fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":{"data":{"player":{"playerid":0,"speed":0}},"sender":"xbmc"}}`, notification))
+}
+
+func newTestClient(t *testing.T, addr string) *Client {
+	return &Client{
+		addr: addr,
+		// Only notifications refresh
+		interval: time.Hour,
+		timeout:  time.Second,
+		events:   make(chan mstatus.Status),
+		log:      mstatus.Logger(t.Log),
+		done:     make(chan struct{}),
+	}
+}
+
+func TestKodiTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &stub{t: t, playing: true}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conns <- conn
+		s.serve(conn)
+	}()
+
+	c := newTestClient(t, ln.Addr().String())
+	go c.Watch()
+	defer c.Stop()
+
+	got := <-c.events
+	expected := mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: mstatus.Player{Name: "kodi", Version: "21.1"},
+		Track: &mstatus.Track{
+			ID:          "42",
+			Title:       "Motherless Children",
+			Artist:      "Eric Clapton",
+			Artists:     []string{"Eric Clapton"},
+			Album:       "461 Ocean Boulevard",
+			AlbumArtist: "Eric Clapton",
+			TrackNumber: 1,
+			DiscNumber:  1,
+			ReleaseDate: "1974",
+			Tags:        []string{"Rock"},
+			Duration:    292 * time.Second,
+			Elapsed:     62500 * time.Millisecond,
+			MbArtistID:  "618b6900-0618-4f1e-b835-bccb17f84294",
+			MbTrackID:   "10aae51f-f253-42c4-8af8-5673da1c98e6",
+			MbReleaseID: "2089dcff-a209-49c4-8bbe-d43328c6efed",
+			URI:         "/music/01.flac",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	s.set(true, true, "Player.OnPause")
+	if got := <-c.events; got.State != mstatus.StatePaused || got.Track == nil {
+		t.Errorf("got %#v", got)
+	}
+	// Only audio players are followed
+	s.set(false, false, "Player.OnStop")
+	if got := <-c.events; got.State != mstatus.StateStopped || got.Track != nil {
+		t.Errorf("got %#v", got)
+	}
+
+	// Disconnecting stops
+	(<-conns).Close()
+	if got := <-c.events; got.State != mstatus.StateStopped {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestKodiWebsocket(t *testing.T) {
+	s := &stub{t: t, playing: true}
+	ts := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		if ws.Request().URL.Path != "/jsonrpc" {
+			t.Errorf("got path %q", ws.Request().URL.Path)
+		}
+		s.serve(ws)
+	}))
+	defer ts.Close()
+
+	c := newTestClient(t, ts.Listener.Addr().String())
+	c.websocket = true
+	go c.Watch()
+	defer c.Stop()
+
+	if got := <-c.events; got.State != mstatus.StatePlaying || got.Track == nil || got.Track.ID != "42" {
+		t.Errorf("got %#v", got)
+	}
+	s.set(false, false, "Player.OnStop")
+	if got := <-c.events; got.State != mstatus.StateStopped {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestKodiStreamID(t *testing.T) {
+	stream := "http://radio.example.com/stream"
+	first := newTrack(item{File: stream, Label: "Artist - First"})
+	second := newTrack(item{File: stream, Title: "Second"})
+	if first.ID == second.ID {
+		t.Errorf("tracks of a stream share ID %q", first.ID)
+	}
+	if first.Title != "Artist - First" || first.URI != stream {
+		t.Errorf("got %#v", first)
+	}
+	// Library IDs are preferred
+	if got := newTrack(item{ID: 42, File: stream, Title: "Second"}); got.ID != "42" {
+		t.Errorf("got ID %q, want 42", got.ID)
+	}
+}
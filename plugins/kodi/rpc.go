@@ -0,0 +1,138 @@
+package kodi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("connection closed")
+
+// RPCError is a JSON-RPC error response.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+type request struct {
+	JSONRPC string      `json:"jsonrpc"`
+	ID      int         `json:"id"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// message is either a response or a notification.
+type message struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+}
+
+// rpcConn is a JSON-RPC connection over TCP or a websocket, neither of
+// which delimit messages.
+type rpcConn struct {
+	rwc     io.ReadWriteCloser
+	timeout time.Duration
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan message
+
+	// changed receives a value when player notifications arrive
+	changed chan struct{}
+	// closed is closed when reading fails
+	closed chan struct{}
+}
+
+func newRPCConn(rwc io.ReadWriteCloser, timeout time.Duration) *rpcConn {
+	c := &rpcConn{
+		rwc:     rwc,
+		timeout: timeout,
+		pending: make(map[int]chan message),
+		changed: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+	go c.read()
+	return c
+}
+
+func (c *rpcConn) read() {
+	defer close(c.closed)
+	dec := json.NewDecoder(c.rwc)
+	for {
+		var msg message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		if msg.ID == nil {
+			if playerNotifications[msg.Method] {
+				// Notifications only prompt a refresh so extras are dropped
+				select {
+				case c.changed <- struct{}{}:
+				default:
+				}
+			}
+			continue
+		}
+		c.mu.Lock()
+		ch := c.pending[*msg.ID]
+		delete(c.pending, *msg.ID)
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// call sends a request and decodes the result into out if not nil.
+func (c *rpcConn) call(method string, params, out interface{}) error {
+	ch := make(chan message, 1)
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	b, err := json.Marshal(request{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	// A single write is a single websocket frame
+	if _, err := c.rwc.Write(b); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		if msg.Error != nil {
+			return fmt.Errorf("%s failed: %w", method, msg.Error)
+		}
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(msg.Result, out)
+	case <-c.closed:
+		return errClosed
+	case <-timer.C:
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+func (c *rpcConn) Close() error {
+	return c.rwc.Close()
+}
@@ -65,6 +65,7 @@ func (c *Client) Watch() error {
 
 	ticker := time.NewTicker(3 * time.Second)
 
+	// The API does not report the version of the player
 	status := mstatus.Status{
 		Player: mstatus.Player{Name: scope},
 	}
@@ -113,8 +114,16 @@ func (c *Client) Watch() error {
 				//Duration:    ,
 				//Elapsed:     elapsed,
 				MbTrackID:   ctrack.Mbid,
-				MbReleaseID: ctrack.Artist.Mbid,
+				MbReleaseID: ctrack.Album.Mbid,
 				MbArtistID:  ctrack.Artist.Mbid,
+				URI:         ctrack.Url,
+			}
+			if ctrack.Artist.Name != "" {
+				status.Track.Artists = []string{ctrack.Artist.Name}
+			}
+			// Images are ordered smallest to largest
+			if n := len(ctrack.Images); n > 0 {
+				status.Track.ArtworkURL = ctrack.Images[n-1].Url
 			}
 			status.State = mstatus.StatePlaying
 			c.events <- status
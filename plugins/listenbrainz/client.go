@@ -3,39 +3,63 @@ package listenbrainz
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"src.userspace.com.au/felix/mstatus"
 )
 
 func init() {
-	mstatus.Register(&Client{
-		apiURL:     submitURL,
+	mstatus.Register(newClient(scope))
+}
+
+func newClient(name string) *Client {
+	return &Client{
+		name:       name,
+		apiURL:     defaultURL,
 		log:        func(...interface{}) {},
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		rule:       mstatus.DefaultListenRule,
 
 		events:       make(chan mstatus.Status),
 		startWatcher: make(chan bool),
-	})
+	}
 }
 
 const (
-	scope       = "listenbrainz"
-	submitURL   = "https://api.listenbrainz.org/1/submit-listens"
-	fetchURLFmt = "https://api.listenbrainz.org/1/user/%s/playing-now"
+	scope      = "listenbrainz"
+	defaultURL = "https://api.listenbrainz.org"
+
+	submitEndpoint   = "/1/submit-listens"
+	validateEndpoint = "/1/validate-token"
+	fetchEndpointFmt = "/1/user/%s/playing-now"
+
+	spotifyTrackURL = "https://open.spotify.com/track/"
+
+	// Wait before retrying after a server or network failure
+	retryInterval = time.Minute
+	// Most completed listens held while unable to submit
+	maxQueue = 1000
 )
 
 type Client struct {
+	// Configuration scope, differs for additional instances
+	name       string
 	token      string
 	apiURL     string
 	httpClient *http.Client
 	log        mstatus.Logger
+	rule       mstatus.ListenRule
 
-	current *payload
+	// Requests are paced until this time once the rate limit is reached
+	resetAt time.Time
 
 	// For a source
 	username     string
@@ -44,12 +68,20 @@ type Client struct {
 	done         chan struct{}
 }
 
-var _ mstatus.Source = (*Client)(nil)
-
-//var _ mstatus.Handler = (*Client)(nil)
+var (
+	_ mstatus.Source    = (*Client)(nil)
+	_ mstatus.Handler   = (*Client)(nil)
+	_ mstatus.Instancer = (*Client)(nil)
+)
 
 func (c *Client) Name() string {
-	return scope
+	return c.name
+}
+
+// NewInstance implements mstatus.Instancer, allowing listens to be sent to
+// several servers.
+func (c *Client) NewInstance(name string) mstatus.Plugin {
+	return newClient(name)
 }
 
 type submission struct {
@@ -68,10 +100,6 @@ func (p payload) String() string {
 
 // Track is a helper struct for marshalling the JSON payload
 type track struct {
-	id          string
-	singleSent  bool
-	playingSent bool
-
 	Title          string         `json:"track_name"`
 	Artist         string         `json:"artist_name"`
 	Album          string         `json:"release_name"`
@@ -80,98 +108,215 @@ type track struct {
 
 type additionalInfo struct {
 	MediaPlayer             string   `json:"media_player,omitempty"`
+	MediaPlayerVersion      string   `json:"media_player_version,omitempty"`
 	SubmissionClient        string   `json:"submission_client,omitempty"`
 	SubmissionClientVersion string   `json:"submission_client_version,omitempty"`
 	ReleaseMBID             string   `json:"release_mbid,omitempty"`
+	ReleaseGroupMBID        string   `json:"release_group_mbid,omitempty"`
 	ArtistMBIDS             []string `json:"artist_mbids,omitempty"`
 	RecordingMBID           string   `json:"recording_mbid,omitempty"`
+	TrackMBID               string   `json:"track_mbid,omitempty"`
 	WorkMBIDs               []string `json:"work_mbids,omitempty"`
+	ArtistNames             []string `json:"artist_names,omitempty"`
+	ReleaseArtistName       string   `json:"release_artist_name,omitempty"`
+	TrackNumber             int      `json:"tracknumber,omitempty"`
+	DiscNumber              int      `json:"discnumber,omitempty"`
+	Date                    string   `json:"date,omitempty"`
+	ISRC                    string   `json:"isrc,omitempty"`
 	Tags                    []string `json:"tags,omitempty"`
+	DurationMS              int64    `json:"duration_ms,omitempty"`
+	SpotifyID               string   `json:"spotify_id,omitempty"`
+	OriginURL               string   `json:"origin_url,omitempty"`
 }
 
 func (c *Client) Load(cfg *mstatus.Session, log mstatus.Logger) error {
 	c.log = log
-	if s := cfg.ConfigString(scope, "token"); s != "" {
+	if s := cfg.ConfigString(c.name, "token"); s != "" {
 		c.token = s
 	}
 	if c.token == "" {
 		return fmt.Errorf("missing listenbrainz token")
 	}
-	if s := cfg.ConfigString(scope, "username"); s != "" {
+	// Other servers implementing the API, such as Maloja or Koito
+	if s := cfg.ConfigString(c.name, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if s := cfg.ConfigString(c.name, "username"); s != "" {
 		c.username = s
 	}
+	rule, err := mstatus.LoadListenRule(cfg, c.name)
+	if err != nil {
+		return err
+	}
+	c.rule = rule
+	return c.validateToken()
+}
+
+// validateToken checks the token, failing only if it is rejected so that
+// starting offline is possible.
+func (c *Client) validateToken() error {
+	req, err := c.newRequest("GET", validateEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Valid    bool   `json:"valid"`
+		Message  string `json:"message"`
+		UserName string `json:"user_name"`
+	}
+	if err := c.do(req, &r); err != nil {
+		var ae *APIError
+		if errors.As(err, &ae) && ae.Code == http.StatusUnauthorized {
+			return fmt.Errorf("invalid listenbrainz token: %w", err)
+		}
+		c.log("listenbrainz failed to validate token", err)
+		return nil
+	}
+	if !r.Valid {
+		return fmt.Errorf("invalid listenbrainz token: %s", r.Message)
+	}
+	if c.username == "" {
+		c.username = r.UserName
+	}
+	c.log("listenbrainz token valid for", r.UserName)
 	return nil
 }
 
+// Start submits listens. Completed listens are queued and retried while
+// rate limited or the server is failing, now playing listens are dropped.
 func (c *Client) Start(events <-chan mstatus.Status) {
-	for event := range events {
-		switch event.State {
-		case mstatus.StatePlaying:
-			if c.current != nil {
-				newTrack := c.current.Track.id != event.Track.ID
-				if newTrack || !c.current.Track.singleSent {
-					// Listens should be submitted for tracks when the user has listened to
-					// half the track or 4 minutes of the track, whichever is lower. If the
-					// user hasn’t listened to 4 minutes or half the track, it doesn’t
-					// fully count as a listen and should not be submitted.
-					// https://listenbrainz.readthedocs.io/en/latest/users/api/core/#post--1-submit-listens
-					elapsed := event.Track.Elapsed.Seconds()
-					pc := elapsed / event.Track.Duration.Seconds()
-					if pc > 0.5 || (elapsed > 240) {
-						if err := c.submit(submission{
-							ListenType: "single",
-							Payloads:   []payload{*c.current},
-						}); err != nil {
-							errorf("failed to submit: %s", err)
-						}
-						c.current.Track.singleSent = true
-					}
-					if newTrack {
-						c.current = nil
+	tracker := mstatus.NewListenTracker(c.rule)
+	listens := tracker.Run(events)
+	var (
+		queue []submission
+		retry <-chan time.Time
+	)
+	for {
+		select {
+		case l, ok := <-listens:
+			if !ok {
+				// One last attempt unless rate limited
+				for len(queue) > 0 && !time.Now().Before(c.resetAt) {
+					if err := c.submit(queue[0]); err != nil {
+						break
 					}
+					queue = queue[1:]
+				}
+				if len(queue) > 0 {
+					errorf("dropping %d unsubmitted listens\n", len(queue))
 				}
+				return
 			}
-			if c.current == nil {
-				c.current = &payload{
-					Track: track{
-						id:     event.Track.ID,
-						Title:  event.Track.Title,
-						Artist: event.Track.Artist,
-						Album:  event.Track.Album,
-						AdditionalInfo: additionalInfo{
-							// TODO store this somewhere else
-							MediaPlayer:             event.Player.Name,
-							SubmissionClient:        "music-status https://github.com/felix/music-status",
-							SubmissionClientVersion: "0.1.0",
-							ReleaseMBID:             event.Track.MbReleaseID,
-							ArtistMBIDS:             []string{event.Track.MbArtistID},
-							//RecordingMBID: string
-							//Tags: []string
-						},
-					},
+			p := newPayload(l)
+			if l.Type == mstatus.ListenCompleted {
+				p.ListenedAt = l.StartedAt.Unix()
+			}
+			sub := submission{
+				ListenType: string(l.Type),
+				Payloads:   []payload{p},
+			}
+			if l.Type != mstatus.ListenCompleted {
+				if time.Now().Before(c.resetAt) || len(queue) > 0 {
+					c.log("listenbrainz skipping now playing", p)
+					continue
+				}
+				if err := c.submit(sub); err != nil {
+					errorf("failed to submit: %s\n", err)
 				}
+				continue
+			}
+			if len(queue) >= maxQueue {
+				errorf("queue full, dropping %s\n", queue[0].Payloads[0])
+				queue = queue[1:]
 			}
+			queue = append(queue, sub)
+
+		case <-retry:
+			retry = nil
+		}
 
-			if !c.current.Track.playingSent {
-				if err := c.submit(submission{
-					ListenType: "playing_now",
-					Payloads:   []payload{*c.current},
-				}); err != nil {
-					errorf("failed to submit: %s", err)
+		for len(queue) > 0 && retry == nil {
+			if wait := time.Until(c.resetAt); wait > 0 {
+				retry = time.After(wait)
+				break
+			}
+			err := c.submit(queue[0])
+			if err != nil && retryable(err) {
+				errorf("failed to submit, will retry: %s\n", err)
+				wait := time.Until(c.resetAt)
+				if wait < retryInterval && !isRateLimited(err) {
+					wait = retryInterval
 				}
-				c.current.ListenedAt = time.Now().Unix()
-				c.current.Track.playingSent = true
+				retry = time.After(wait)
+				break
 			}
-
-		case mstatus.StateStopped:
-			c.current = nil
+			if err != nil {
+				errorf("failed to submit: %s\n", err)
+			}
+			queue = queue[1:]
 		}
 	}
 }
 
+func newPayload(l mstatus.Listen) payload {
+	info := additionalInfo{
+		MediaPlayer:             l.Player.Name,
+		MediaPlayerVersion:      l.Player.Version,
+		SubmissionClient:        mstatus.ClientName + " " + mstatus.ClientURL,
+		SubmissionClientVersion: mstatus.Version(),
+		ReleaseMBID:             l.Track.MbReleaseID,
+		ReleaseGroupMBID:        l.Track.MbReleaseGroupID,
+		RecordingMBID:           l.Track.MbTrackID,
+		TrackMBID:               l.Track.MbReleaseTrackID,
+		ArtistNames:             l.Track.Artists,
+		ReleaseArtistName:       l.Track.AlbumArtist,
+		TrackNumber:             l.Track.TrackNumber,
+		DiscNumber:              l.Track.DiscNumber,
+		Date:                    l.Track.ReleaseDate,
+		ISRC:                    l.Track.ISRC,
+		Tags:                    l.Track.Tags,
+		DurationMS:              l.Track.Duration.Milliseconds(),
+	}
+	if l.Track.MbArtistID != "" {
+		info.ArtistMBIDS = []string{l.Track.MbArtistID}
+	}
+	if l.Track.MbWorkID != "" {
+		info.WorkMBIDs = []string{l.Track.MbWorkID}
+	}
+	info.SpotifyID, info.OriginURL = trackURLs(l.Track.URI)
+
+	return payload{
+		Track: track{
+			Title:          l.Track.Title,
+			Artist:         l.Track.Artist,
+			Album:          l.Track.Album,
+			AdditionalInfo: info,
+		},
+	}
+}
+
+// trackURLs returns the Spotify URL and origin URL for a track URI. Local
+// file paths return neither.
+func trackURLs(uri string) (spotify, origin string) {
+	switch {
+	case strings.HasPrefix(uri, "spotify:track:"):
+		spotify = spotifyTrackURL + strings.TrimPrefix(uri, "spotify:track:")
+		origin = spotify
+	case strings.HasPrefix(uri, spotifyTrackURL):
+		spotify, origin = uri, uri
+	case strings.HasPrefix(uri, "http://"), strings.HasPrefix(uri, "https://"):
+		origin = uri
+	}
+	return spotify, origin
+}
+
 func (c *Client) Stop() error {
-	close(c.done)
-	c.current = nil
+	if c.done != nil {
+		close(c.done)
+	}
 	return nil
 }
 
@@ -181,27 +326,95 @@ func (c *Client) submit(sub submission) error {
 	if err := enc.Encode(sub); err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", c.apiURL, buf)
+	req, err := c.newRequest("POST", submitEndpoint, buf)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.token))
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		var body []byte
-		if resp != nil && resp.StatusCode != 200 {
-			if resp.Body != nil {
-				body, _ = io.ReadAll(resp.Body)
-			}
-			err = fmt.Errorf("failed to set status: %w %d %q", err, resp.StatusCode, string(body))
-		}
+	if err := c.do(req, nil); err != nil {
 		return err
 	}
 	c.log("listenbrainz published", sub.ListenType, sub.Payloads[0])
 	return nil
 }
 
+func (c *Client) newRequest(method, endpoint string, body io.Reader) (*http.Request, error) {
+	uri, err := url.JoinPath(c.apiURL, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return http.NewRequest(method, uri, body)
+}
+
+// APIError is an error response from ListenBrainz.
+type APIError struct {
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("listenbrainz request failed: %d %s", e.Code, e.Message)
+}
+
+// retryable reports whether a failed request may succeed later.
+func retryable(err error) bool {
+	var ae *APIError
+	if errors.As(err, &ae) {
+		return ae.Code == http.StatusTooManyRequests || ae.Code >= 500
+	}
+	// Network failures
+	return true
+}
+
+func isRateLimited(err error) bool {
+	var ae *APIError
+	return errors.As(err, &ae) && ae.Code == http.StatusTooManyRequests
+}
+
+// do performs an authenticated request, decoding a successful response into
+// out if not nil. The rate limit headers are used to pace later requests.
+func (c *Client) do(req *http.Request, out interface{}) error {
+	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.token))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.updateRateLimit(resp)
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		ae := &APIError{Code: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+		var r struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &r) == nil && r.Error != "" {
+			ae.Message = r.Error
+		}
+		return ae
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// updateRateLimit delays further requests once none remain in the window.
+func (c *Client) updateRateLimit(resp *http.Response) {
+	resetIn, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Reset-In"))
+	if err != nil {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			c.resetAt = time.Now().Add(retryInterval)
+		}
+		return
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if resp.StatusCode == http.StatusTooManyRequests || (err == nil && remaining <= 0) {
+		c.resetAt = time.Now().Add(time.Duration(resetIn) * time.Second)
+	}
+}
+
 //	{ "payload":{
 //		"count":1,
 //		"listens":[{
@@ -241,9 +454,18 @@ type listenPayload struct {
 				ArtistName     string `json:"artist_name"`
 				ReleaseName    string `json:"release_name"`
 				AdditionalInfo struct {
-					RecordingMBID string `json:"recording_mbid"`
-					//ReleaseMBID   string `json:"release_mbid"`
-					Duration int `json:"duration"`
+					RecordingMBID string   `json:"recording_mbid"`
+					ReleaseMBID   string   `json:"release_mbid"`
+					ArtistMBIDs   []string `json:"artist_mbids"`
+					WorkMBIDs     []string `json:"work_mbids"`
+					AlbumArtist   string   `json:"albumartist"`
+					Date          string   `json:"date"`
+					DiscNumber    int      `json:"discnumber"`
+					TrackNumber   int      `json:"tracknumber"`
+					Genre         string   `json:"genre"`
+					ISRC          string   `json:"isrc"`
+					OriginURL     string   `json:"origin_url"`
+					Duration      int      `json:"duration"`
 				} `json:"additional_info"`
 			} `json:"track_metadata"`
 		} `json:"listens"`
@@ -262,7 +484,7 @@ func (c *Client) Watch() error {
 	ticker := time.NewTicker(3 * time.Second)
 
 	status := mstatus.Status{
-		Player: mstatus.Player{Name: scope},
+		Player: mstatus.Player{Name: c.name},
 	}
 
 	for {
@@ -273,16 +495,19 @@ func (c *Client) Watch() error {
 			return nil
 
 		case <-ticker.C:
-			res, err := c.httpClient.Get(fmt.Sprintf(fetchURLFmt, c.username))
+			req, err := c.newRequest("GET", fmt.Sprintf(fetchEndpointFmt, url.PathEscape(c.username)), nil)
 			if err != nil {
-				c.log("failed to get recent tracks", err)
 				return err
 			}
-
-			dec := json.NewDecoder(res.Body)
 			var results listenPayload
-			if err := dec.Decode(&results); err != nil {
-				c.log("failed to parse results", err)
+			if err := c.do(req, &results); err != nil {
+				c.log("failed to get recent tracks", err)
+				// Only network failures stop the source
+				var ue *url.Error
+				if errors.As(err, &ue) {
+					return err
+				}
+				continue
 			}
 
 			if !results.Payload.PlayingNow || len(results.Payload.Listens) < 1 {
@@ -294,16 +519,31 @@ func (c *Client) Watch() error {
 
 			var duration = time.Duration(float64(ctrack.TrackMetadata.AdditionalInfo.Duration) * float64(time.Second))
 
+			info := ctrack.TrackMetadata.AdditionalInfo
 			status.Track = &mstatus.Track{
-				ID:       ctrack.TrackMetadata.AdditionalInfo.RecordingMBID,
-				Title:    ctrack.TrackMetadata.TrackName,
-				Artist:   ctrack.TrackMetadata.ArtistName,
-				Album:    ctrack.TrackMetadata.ReleaseName,
-				Duration: duration,
+				ID:          info.RecordingMBID,
+				Title:       ctrack.TrackMetadata.TrackName,
+				Artist:      ctrack.TrackMetadata.ArtistName,
+				Album:       ctrack.TrackMetadata.ReleaseName,
+				AlbumArtist: info.AlbumArtist,
+				TrackNumber: info.TrackNumber,
+				DiscNumber:  info.DiscNumber,
+				ReleaseDate: info.Date,
+				Duration:    duration,
 				//Elapsed:     elapsed,
-				MbTrackID: ctrack.TrackMetadata.AdditionalInfo.RecordingMBID,
-				//MbReleaseID: ctrack.TrackMetadata.AdditionalInfo.ReleaseMBID,
-				//MbArtistID:  ctrack.Artist.Mbid,
+				MbTrackID:   info.RecordingMBID,
+				MbReleaseID: info.ReleaseMBID,
+				ISRC:        info.ISRC,
+				URI:         info.OriginURL,
+			}
+			if len(info.ArtistMBIDs) > 0 {
+				status.Track.MbArtistID = info.ArtistMBIDs[0]
+			}
+			if len(info.WorkMBIDs) > 0 {
+				status.Track.MbWorkID = info.WorkMBIDs[0]
+			}
+			if info.Genre != "" {
+				status.Track.Tags = []string{info.Genre}
 			}
 			status.State = mstatus.StatePlaying
 			c.events <- status
@@ -21,14 +21,16 @@ func TestListenbrainzHandle(t *testing.T) {
 	}
 	addInfo := additionalInfo{
 		SubmissionClient:        "music-status https://github.com/felix/music-status",
-		SubmissionClientVersion: "0.1.0",
-		ArtistMBIDS:             []string{""},
+		SubmissionClientVersion: mstatus.Version(),
 	}
+	withDuration := addInfo
+	withDuration.DurationMS = 90000
 	tests := map[string]struct {
-		status  mstatus.Status
-		current *payload
-		sub     submission
-		failure bool
+		previous []mstatus.Status
+		status   mstatus.Status
+		sub      submission
+		subs     int
+		failure  bool
 	}{
 		"stopped": {
 			status: mstatus.Status{
@@ -42,7 +44,6 @@ func TestListenbrainzHandle(t *testing.T) {
 				State: mstatus.StatePlaying,
 				Track: &playingTrack,
 			},
-			//current: &payload{Track: track{ID: "current"}},
 			sub: submission{
 				ListenType: "playing_now",
 				Payloads: []payload{{
@@ -54,6 +55,7 @@ func TestListenbrainzHandle(t *testing.T) {
 					}},
 				},
 			},
+			subs: 1,
 		},
 		"continued play": {
 			status: mstatus.Status{
@@ -73,38 +75,115 @@ func TestListenbrainzHandle(t *testing.T) {
 						Title:          "continued play",
 						Artist:         "artist",
 						Album:          "album",
-						AdditionalInfo: addInfo,
+						AdditionalInfo: withDuration,
+					}},
+				},
+			},
+			subs: 1,
+		},
+		"full metadata": {
+			status: mstatus.Status{
+				State: mstatus.StatePlaying,
+				Track: &mstatus.Track{
+					ID:               "id",
+					Title:            "title",
+					Artist:           "artist",
+					Artists:          []string{"artist", "other"},
+					Album:            "album",
+					AlbumArtist:      "album artist",
+					TrackNumber:      3,
+					DiscNumber:       1,
+					ReleaseDate:      "1974",
+					Tags:             []string{"Rock"},
+					Duration:         3*time.Minute + 500*time.Millisecond,
+					MbArtistID:       "artist-mbid",
+					MbTrackID:        "recording-mbid",
+					MbReleaseID:      "release-mbid",
+					MbReleaseTrackID: "track-mbid",
+					MbReleaseGroupID: "release-group-mbid",
+					MbWorkID:         "work-mbid",
+					ISRC:             "GBF077420010",
+					URI:              "spotify:track:4uLU6hMCjMI75M1A2tKUQC",
+				}},
+			sub: submission{
+				ListenType: "playing_now",
+				Payloads: []payload{{
+					Track: track{
+						Title:  "title",
+						Artist: "artist",
+						Album:  "album",
+						AdditionalInfo: additionalInfo{
+							SubmissionClient:        addInfo.SubmissionClient,
+							SubmissionClientVersion: addInfo.SubmissionClientVersion,
+							ReleaseMBID:             "release-mbid",
+							ReleaseGroupMBID:        "release-group-mbid",
+							ArtistMBIDS:             []string{"artist-mbid"},
+							RecordingMBID:           "recording-mbid",
+							TrackMBID:               "track-mbid",
+							WorkMBIDs:               []string{"work-mbid"},
+							ArtistNames:             []string{"artist", "other"},
+							ReleaseArtistName:       "album artist",
+							TrackNumber:             3,
+							DiscNumber:              1,
+							Date:                    "1974",
+							ISRC:                    "GBF077420010",
+							Tags:                    []string{"Rock"},
+							DurationMS:              180500,
+							SpotifyID:               "https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC",
+							OriginURL:               "https://open.spotify.com/track/4uLU6hMCjMI75M1A2tKUQC",
+						},
 					}},
 				},
 			},
+			subs: 1,
 		},
 		"old play": {
+			previous: []mstatus.Status{{
+				State: mstatus.StatePlaying,
+				Track: &mstatus.Track{
+					ID:       "id",
+					Title:    "old play",
+					Artist:   "artist",
+					Album:    "album",
+					Duration: 90 * time.Second,
+					Elapsed:  time.Minute,
+				}},
+			},
 			status: mstatus.Status{
 				State: mstatus.StatePlaying,
 				Track: &mstatus.Track{
 					ID:       "id",
+					Title:    "old play",
 					Artist:   "artist",
 					Album:    "album",
 					Duration: 90 * time.Second,
 					Elapsed:  time.Minute,
 				}},
-			current: &payload{Track: track{
-				id:          "id",
-				singleSent:  true,
-				playingSent: true,
-			}},
-			sub: submission{},
+			sub: submission{
+				ListenType: "playing_now",
+				Payloads: []payload{{
+					Track: track{
+						Title:          "old play",
+						Artist:         "artist",
+						Album:          "album",
+						AdditionalInfo: withDuration,
+					}},
+				},
+			},
+			subs: 1,
 		},
 	}
 
 	for name, tt := range tests {
 		t.Run(name, func(t *testing.T) {
 			var sub submission
+			var subs int
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				dec := json.NewDecoder(r.Body)
 				if err := dec.Decode(&sub); err != nil {
 					t.Fatalf("failed to decode %s", err)
 				}
+				subs++
 				t.Logf("submission: %#v", sub)
 				fmt.Fprintln(w, "OK")
 			}))
@@ -114,17 +193,23 @@ func TestListenbrainzHandle(t *testing.T) {
 				token:  "token",
 				apiURL: ts.URL,
 				log:    mstatus.Logger(t.Log),
+				rule:   mstatus.DefaultListenRule,
 			}
 			c.httpClient = ts.Client()
 			c.apiURL = ts.URL
-			c.current = tt.current
 
 			ch := make(chan mstatus.Status)
 			go func() {
+				for _, s := range tt.previous {
+					ch <- s
+				}
 				ch <- tt.status
 				close(ch)
 			}()
 			c.Start(ch)
+			if subs != tt.subs {
+				t.Fatalf("got %d submissions, want %d", subs, tt.subs)
+			}
 			if len(sub.Payloads) != len(tt.sub.Payloads) {
 				t.Fatalf("got %d, want %d", len(sub.Payloads), len(tt.sub.Payloads))
 			}
@@ -138,3 +223,224 @@ func TestListenbrainzHandle(t *testing.T) {
 	}
 
 }
+
+func TestListenbrainzSubmitErrors(t *testing.T) {
+	tests := map[string]struct {
+		status    int
+		header    map[string]string
+		body      string
+		message   string
+		retryable bool
+		limited   bool
+	}{
+		"bad request": {
+			status:  http.StatusBadRequest,
+			body:    `{"code":400,"error":"JSON document must contain payload"}`,
+			message: "listenbrainz request failed: 400 JSON document must contain payload",
+		},
+		"unauthorized": {
+			status:  http.StatusUnauthorized,
+			body:    `{"code":401,"error":"Invalid authorization token."}`,
+			message: "listenbrainz request failed: 401 Invalid authorization token.",
+		},
+		"rate limited": {
+			status:    http.StatusTooManyRequests,
+			header:    map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset-In": "30"},
+			body:      `{"code":429,"error":"Too many requests"}`,
+			message:   "listenbrainz request failed: 429 Too many requests",
+			retryable: true,
+			limited:   true,
+		},
+		"server error": {
+			status:    http.StatusBadGateway,
+			body:      "<html>bad gateway</html>",
+			message:   "listenbrainz request failed: 502 <html>bad gateway</html>",
+			retryable: true,
+		},
+		"limit reached": {
+			status:  http.StatusOK,
+			header:  map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset-In": "30"},
+			body:    `{"status":"ok"}`,
+			limited: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Token token" {
+					t.Errorf("got authorization %q", r.Header.Get("Authorization"))
+				}
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				token:      "token",
+				apiURL:     ts.URL,
+				httpClient: ts.Client(),
+				log:        mstatus.Logger(t.Log),
+			}
+			err := c.submit(submission{
+				ListenType: "single",
+				Payloads:   []payload{{Track: track{Title: "title"}}},
+			})
+			if tt.message == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %s", err)
+				}
+			} else {
+				if err == nil || err.Error() != tt.message {
+					t.Fatalf("got %v, want %q", err, tt.message)
+				}
+				if retryable(err) != tt.retryable {
+					t.Errorf("got retryable %t", retryable(err))
+				}
+			}
+			if wait := time.Until(c.resetAt); tt.limited != (wait > 29*time.Second) {
+				t.Errorf("got reset in %s", wait)
+			}
+		})
+	}
+}
+
+func TestListenbrainzValidateToken(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		body    string
+		invalid bool
+	}{
+		"valid": {
+			status: http.StatusOK,
+			body:   `{"code":200,"message":"Token valid.","valid":true,"user_name":"user"}`,
+		},
+		"invalid": {
+			status:  http.StatusOK,
+			body:    `{"code":200,"message":"Token invalid.","valid":false}`,
+			invalid: true,
+		},
+		"unauthorized": {
+			status:  http.StatusUnauthorized,
+			body:    `{"code":401,"error":"You need to provide an Authorization header."}`,
+			invalid: true,
+		},
+		// Starting while the server is down is allowed
+		"unavailable": {
+			status: http.StatusServiceUnavailable,
+			body:   "unavailable",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				token:      "token",
+				apiURL:     ts.URL,
+				httpClient: ts.Client(),
+				log:        mstatus.Logger(t.Log),
+			}
+			err := c.validateToken()
+			if (err != nil) != tt.invalid {
+				t.Fatalf("got %v, want invalid %t", err, tt.invalid)
+			}
+			if name == "valid" && c.username != "user" {
+				t.Errorf("got username %q", c.username)
+			}
+		})
+	}
+}
+
+func TestListenbrainzRetry(t *testing.T) {
+	var attempts, accepted int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var sub submission
+		json.NewDecoder(r.Body).Decode(&sub)
+		if sub.ListenType != "single" {
+			fmt.Fprint(w, `{"status":"ok"}`)
+			return
+		}
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset-In", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"code":429,"error":"Too many requests"}`)
+			return
+		}
+		if sub.Payloads[0].ListenedAt == 0 {
+			t.Error("missing listened_at")
+		}
+		accepted++
+		fmt.Fprint(w, `{"status":"ok"}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		token:      "token",
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		rule:       mstatus.ListenRule{},
+		log:        mstatus.Logger(t.Log),
+	}
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+	ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &mstatus.Track{ID: "1", Title: "one", Duration: time.Second}}
+	time.Sleep(20 * time.Millisecond)
+	ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &mstatus.Track{ID: "1", Title: "one", Duration: time.Second, Elapsed: 20 * time.Millisecond}}
+	ch <- mstatus.Status{State: mstatus.StateStopped}
+	// A second event lets the retry run
+	time.Sleep(50 * time.Millisecond)
+	ch <- mstatus.Status{State: mstatus.StateStopped}
+	time.Sleep(50 * time.Millisecond)
+	close(ch)
+	<-done
+
+	if attempts != 2 || accepted != 1 {
+		t.Errorf("got %d attempts and %d accepted, want 2 and 1", attempts, accepted)
+	}
+}
+
+func TestListenbrainzInstance(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, `{"code":200,"message":"Token valid.","valid":true,"user_name":"user"}`)
+	}))
+	defer ts.Close()
+
+	c, ok := newClient(scope).NewInstance("koito").(*Client)
+	if !ok || c.Name() != "koito" {
+		t.Fatalf("got %#v", c)
+	}
+	// A ListenBrainz compatible API below a path
+	c.apiURL = ts.URL + "/apis/listenbrainz"
+	c.token = "token"
+	c.httpClient = ts.Client()
+	if err := c.validateToken(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.submit(submission{
+		ListenType: "single",
+		Payloads:   []payload{{Track: track{Title: "title"}}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/apis/listenbrainz/1/validate-token", "/apis/listenbrainz/1/submit-listens"}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("got %q, want %q", paths, expected)
+	}
+}
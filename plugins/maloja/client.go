@@ -0,0 +1,158 @@
+package maloja
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		rule:       mstatus.DefaultListenRule,
+		log:        func(...interface{}) {},
+	})
+}
+
+const (
+	scope            = "maloja"
+	scrobbleEndpoint = "/apis/mlj_1/newscrobble"
+)
+
+// Client records completed listens with Maloja's native API.
+type Client struct {
+	apiURL     string
+	key        string
+	httpClient *http.Client
+	rule       mstatus.ListenRule
+	log        mstatus.Logger
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+// scrobble is the body of newscrobble.
+type scrobble struct {
+	Artists      []string `json:"artists"`
+	Title        string   `json:"title"`
+	Album        string   `json:"album,omitempty"`
+	AlbumArtists []string `json:"albumartists,omitempty"`
+	// Seconds listened
+	Duration int64 `json:"duration,omitempty"`
+	// Seconds in the track
+	Length int64  `json:"length,omitempty"`
+	Time   int64  `json:"time"`
+	Key    string `json:"key"`
+}
+
+func (s scrobble) String() string {
+	return fmt.Sprintf("%q by %s", s.Title, strings.Join(s.Artists, ", "))
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing maloja url")
+	}
+	c.key = sess.ConfigString(scope, "key")
+	if c.key == "" {
+		return fmt.Errorf("missing maloja key")
+	}
+	var err error
+	c.rule, err = mstatus.LoadListenRule(sess, scope)
+	return err
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	tracker := mstatus.NewListenTracker(c.rule)
+	for l := range tracker.Run(events) {
+		if l.Type != mstatus.ListenCompleted {
+			continue
+		}
+		if err := c.submit(c.newScrobble(l)); err != nil {
+			errorf("failed to scrobble: %s\n", err)
+		}
+	}
+}
+
+func (c *Client) newScrobble(l mstatus.Listen) scrobble {
+	s := scrobble{
+		Artists:  l.Track.Artists,
+		Title:    l.Track.Title,
+		Album:    l.Track.Album,
+		Duration: int64(l.Listened.Seconds()),
+		Length:   int64(l.Track.Duration.Seconds()),
+		Time:     l.StartedAt.Unix(),
+		Key:      c.key,
+	}
+	if len(s.Artists) == 0 && l.Track.Artist != "" {
+		s.Artists = []string{l.Track.Artist}
+	}
+	if l.Track.AlbumArtist != "" {
+		s.AlbumArtists = []string{l.Track.AlbumArtist}
+	}
+	return s
+}
+
+func (c *Client) submit(s scrobble) error {
+	uri, err := url.JoinPath(c.apiURL, scrobbleEndpoint)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Status string `json:"status"`
+		Error  struct {
+			Type string `json:"type"`
+			Desc string `json:"desc"`
+		} `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("maloja request failed: %d %q", resp.StatusCode, string(body))
+	}
+	if resp.StatusCode != http.StatusOK || r.Status != "success" {
+		return fmt.Errorf("maloja request failed: %d %s %s", resp.StatusCode, r.Error.Type, r.Error.Desc)
+	}
+	c.log("maloja scrobbled", s)
+	return nil
+}
+
+func (c *Client) Stop() error {
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "maloja error: "+format, v...)
+}
@@ -0,0 +1,93 @@
+package maloja
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func TestMalojaScrobble(t *testing.T) {
+	var got []scrobble
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != scrobbleEndpoint {
+			t.Errorf("got path %q", r.URL.Path)
+		}
+		var s scrobble
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Error(err)
+		}
+		if s.Key != "key" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"status":"error","error":{"type":"authentication_fail","desc":"Invalid or missing API key"}}`)
+			return
+		}
+		got = append(got, s)
+		fmt.Fprint(w, `{"status":"success","track":{"artists":["artist"],"title":"title"}}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL,
+		key:        "key",
+		httpClient: ts.Client(),
+		// Any listening counts
+		rule: mstatus.ListenRule{},
+		log:  mstatus.Logger(t.Log),
+	}
+	track := mstatus.Track{
+		ID:          "1",
+		Title:       "title",
+		Artist:      "artist",
+		Artists:     []string{"artist", "other"},
+		Album:       "album",
+		AlbumArtist: "album artist",
+		Duration:    3 * time.Minute,
+	}
+
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+	ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &track}
+	time.Sleep(20 * time.Millisecond)
+	listened := track
+	listened.Elapsed = 20 * time.Millisecond
+	ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &listened}
+	ch <- mstatus.Status{State: mstatus.StateStopped}
+	close(ch)
+	<-done
+
+	if len(got) != 1 {
+		t.Fatalf("got %d scrobbles, want 1", len(got))
+	}
+	if got[0].Time == 0 {
+		t.Error("missing time")
+	}
+	got[0].Time = 0
+	expected := scrobble{
+		Artists:      []string{"artist", "other"},
+		Title:        "title",
+		Album:        "album",
+		AlbumArtists: []string{"album artist"},
+		Length:       180,
+		Key:          "key",
+	}
+	if !reflect.DeepEqual(got[0], expected) {
+		t.Errorf("got %#v, want %#v", got[0], expected)
+	}
+
+	// Failures are reported
+	c.key = "bad"
+	err := c.submit(c.newScrobble(mstatus.Listen{Track: track}))
+	if err == nil || err.Error() != "maloja request failed: 403 authentication_fail Invalid or missing API key" {
+		t.Errorf("got %v", err)
+	}
+}
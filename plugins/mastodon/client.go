@@ -0,0 +1,393 @@
+package mastodon
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+		mode:        modePost,
+		visibility:  "unlisted",
+		fieldName:   defaultFieldName,
+		minInterval: defaultMinInterval,
+		rule:        mstatus.DefaultListenRule,
+		log:         func(...interface{}) {},
+	})
+}
+
+const (
+	scope              = "mastodon"
+	defaultTemplate    = `{{.Track.Title}} by {{.Track.Artist}}{{if .Track.Album}} from {{.Track.Album}}{{end}}`
+	defaultFieldName   = "Now playing"
+	defaultMinInterval = 10 * time.Minute
+	// Minimum wait before retrying a failed profile update
+	retryInterval = time.Minute
+	// Mastodon limits profiles to 4 fields by default
+	maxFields = 4
+)
+
+// Modes of publishing
+const (
+	// modePost posts a status for each completed listen
+	modePost = "post"
+	// modeProfile updates a profile field with the current track
+	modeProfile = "profile"
+)
+
+// Client publishes to Mastodon or another server implementing its API.
+type Client struct {
+	apiURL     string
+	token      string
+	httpClient *http.Client
+	log        mstatus.Logger
+
+	mode     string
+	template *template.Template
+	// For posts
+	visibility  string
+	spoiler     string
+	hashtags    []string
+	rule        mstatus.ListenRule
+	lastPost    time.Time
+	minInterval time.Duration
+	// For profile updates
+	fieldName  string
+	lastValue  string
+	lastUpdate time.Time
+
+	// Requests are refused until this time after being rate limited
+	blockedUntil time.Time
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+type field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing mastodon url")
+	}
+	c.token = sess.ConfigString(scope, "token")
+	if c.token == "" {
+		return fmt.Errorf("missing mastodon token")
+	}
+
+	if s := sess.ConfigString(scope, "mode"); s != "" {
+		c.mode = s
+	}
+	if c.mode != modePost && c.mode != modeProfile {
+		return fmt.Errorf("invalid mastodon mode %q", c.mode)
+	}
+	text := defaultTemplate
+	if s := sess.ConfigString(scope, "template"); s != "" {
+		text = s
+	}
+	var err error
+	if c.template, err = mstatus.NewTemplate("text", text); err != nil {
+		return err
+	}
+
+	if s := sess.ConfigString(scope, "visibility"); s != "" {
+		c.visibility = s
+	}
+	c.spoiler = sess.ConfigString(scope, "contentWarning")
+	for _, tag := range strings.Split(sess.ConfigString(scope, "hashtags"), ",") {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "#"); tag != "" {
+			c.hashtags = append(c.hashtags, "#"+tag)
+		}
+	}
+	if c.rule, err = mstatus.LoadListenRule(sess, scope); err != nil {
+		return err
+	}
+	if s := sess.ConfigString(scope, "minInterval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.minInterval = d
+	}
+	if s := sess.ConfigString(scope, "field"); s != "" {
+		c.fieldName = s
+	}
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	tracker := mstatus.NewListenTracker(c.rule)
+	var (
+		// Profile value waiting for the minimum interval
+		pending *string
+		retry   <-chan time.Time
+	)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if c.mode == modePost {
+					for _, l := range tracker.Flush() {
+						c.handleListen(l)
+					}
+				}
+				return
+			}
+			if c.mode == modePost {
+				for _, l := range tracker.Update(event) {
+					if l.Type == mstatus.ListenCompleted {
+						c.handleListen(l)
+					}
+				}
+				continue
+			}
+			v, err := c.profileValue(event)
+			if err != nil {
+				errorf("failed to format: %s\n", err)
+				continue
+			}
+			if v == c.lastValue {
+				pending = nil
+				continue
+			}
+			pending = &v
+
+		case <-retry:
+			retry = nil
+		}
+
+		if pending == nil || retry != nil {
+			continue
+		}
+		if wait := c.wait(c.lastUpdate); wait > 0 {
+			retry = time.After(wait)
+			continue
+		}
+		c.lastUpdate = time.Now()
+		if err := c.setField(*pending); err != nil {
+			errorf("failed to update profile: %s\n", err)
+			wait := c.wait(c.lastUpdate)
+			if wait < retryInterval {
+				wait = retryInterval
+			}
+			retry = time.After(wait)
+			continue
+		}
+		c.lastValue = *pending
+		pending = nil
+	}
+}
+
+// wait returns how long until a request is allowed, given the last one.
+func (c *Client) wait(last time.Time) time.Duration {
+	wait := c.minInterval - time.Since(last)
+	if d := time.Until(c.blockedUntil); d > wait {
+		wait = d
+	}
+	return wait
+}
+
+func (c *Client) profileValue(s mstatus.Status) (string, error) {
+	if s.State != mstatus.StatePlaying || s.Track == nil {
+		return "", nil
+	}
+	return mstatus.ExecuteTemplate(c.template, s)
+}
+
+// handleListen posts a completed listen unless one was posted recently.
+func (c *Client) handleListen(l mstatus.Listen) {
+	if wait := c.wait(c.lastPost); wait > 0 {
+		c.log("mastodon skipping listen", l.Track, "next post allowed in", wait.Round(time.Second))
+		return
+	}
+	c.lastPost = time.Now()
+	if err := c.post(l); err != nil {
+		errorf("failed to post: %s\n", err)
+	}
+}
+
+func (c *Client) post(l mstatus.Listen) error {
+	text, err := mstatus.ExecuteTemplate(c.template, mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: l.Player,
+		Track:  &l.Track,
+	})
+	if err != nil {
+		return err
+	}
+	if len(c.hashtags) > 0 {
+		text += "\n\n" + strings.Join(c.hashtags, " ")
+	}
+	form := url.Values{
+		"status":     {text},
+		"visibility": {c.visibility},
+	}
+	if c.spoiler != "" {
+		form.Set("spoiler_text", c.spoiler)
+	}
+
+	// Avoid duplicate posts if a request is retried
+	sum := sha1.Sum([]byte(strconv.FormatInt(l.StartedAt.UnixNano(), 10) + l.Track.String()))
+	req, err := c.newRequest("POST", "/api/v1/statuses", form)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Idempotency-Key", hex.EncodeToString(sum[:]))
+	if err := c.do(req, nil); err != nil {
+		return err
+	}
+	c.log("mastodon posted", l.Track)
+	return nil
+}
+
+// setField sets the profile field to value, removing it if value is empty.
+// Other fields are preserved.
+func (c *Client) setField(value string) error {
+	req, err := c.newRequest("GET", "/api/v1/accounts/verify_credentials", nil)
+	if err != nil {
+		return err
+	}
+	var account struct {
+		Source struct {
+			Fields []field `json:"fields"`
+		} `json:"source"`
+	}
+	if err := c.do(req, &account); err != nil {
+		return err
+	}
+
+	var fields []field
+	found := false
+	for _, f := range account.Source.Fields {
+		if f.Name == c.fieldName {
+			found = true
+			if value == "" {
+				continue
+			}
+			f.Value = value
+		}
+		fields = append(fields, f)
+	}
+	if !found {
+		if value == "" {
+			return nil
+		}
+		if len(fields) >= maxFields {
+			return fmt.Errorf("no free profile field for %q", c.fieldName)
+		}
+		fields = append(fields, field{Name: c.fieldName, Value: value})
+	}
+
+	form := url.Values{}
+	for i, f := range fields {
+		form.Set(fmt.Sprintf("fields_attributes[%d][name]", i), f.Name)
+		form.Set(fmt.Sprintf("fields_attributes[%d][value]", i), f.Value)
+	}
+	// An empty set of fields must still be sent to clear them
+	if len(fields) == 0 {
+		form.Set("fields_attributes[0][name]", "")
+		form.Set("fields_attributes[0][value]", "")
+	}
+	if req, err = c.newRequest("PATCH", "/api/v1/accounts/update_credentials", form); err != nil {
+		return err
+	}
+	if err := c.do(req, nil); err != nil {
+		return err
+	}
+	c.log("mastodon profile updated", value)
+	return nil
+}
+
+func (c *Client) newRequest(method, endpoint string, form url.Values) (*http.Request, error) {
+	uri, err := url.JoinPath(c.apiURL, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req, nil
+}
+
+var errRateLimited = errors.New("rate limited")
+
+// do performs a request, decoding the response into v if not nil.
+func (c *Client) do(req *http.Request, v any) error {
+	if time.Now().Before(c.blockedUntil) {
+		return errRateLimited
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.blockedUntil = time.Now().Add(c.minInterval)
+		if t, err := time.Parse(time.RFC3339, resp.Header.Get("X-RateLimit-Reset")); err == nil {
+			c.blockedUntil = t
+		}
+		return fmt.Errorf("%w until %s", errRateLimited, c.blockedUntil.Format(time.RFC3339))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var r struct {
+			Error string `json:"error"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(body, &r) == nil && r.Error != "" {
+			return fmt.Errorf("mastodon request failed: %d %s", resp.StatusCode, r.Error)
+		}
+		return fmt.Errorf("mastodon request failed: %d %q", resp.StatusCode, string(body))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Stop removes the profile field, which fails while rate limited.
+func (c *Client) Stop() error {
+	if c.mode != modeProfile || c.lastValue == "" {
+		return nil
+	}
+	return c.setField("")
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mastodon error: "+format, v...)
+}
@@ -0,0 +1,182 @@
+package mastodon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+// stub is a minimal Mastodon API.
+type stub struct {
+	fields   []field
+	posts    []url.Values
+	limited  bool
+	requests int
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"The access token is invalid"}`))
+		return
+	}
+	if s.limited {
+		w.Header().Set("X-RateLimit-Reset", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	r.ParseForm()
+	switch r.Method + " " + r.URL.Path {
+	case "POST /api/v1/statuses":
+		s.posts = append(s.posts, r.PostForm)
+		w.Write([]byte(`{"id":"1"}`))
+	case "GET /api/v1/accounts/verify_credentials":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"source": map[string]interface{}{"fields": s.fields},
+		})
+	case "PATCH /api/v1/accounts/update_credentials":
+		s.fields = nil
+		for i := 0; ; i++ {
+			name, ok := r.PostForm[fieldKey(i, "name")]
+			if !ok {
+				break
+			}
+			if name[0] != "" {
+				s.fields = append(s.fields, field{Name: name[0], Value: r.PostForm.Get(fieldKey(i, "value"))})
+			}
+		}
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func fieldKey(i int, k string) string {
+	return fmt.Sprintf("fields_attributes[%d][%s]", i, k)
+}
+
+func newClient(t *testing.T, uri string) *Client {
+	t.Helper()
+	c := &Client{
+		apiURL:      uri,
+		token:       "token",
+		httpClient:  http.DefaultClient,
+		visibility:  "unlisted",
+		fieldName:   defaultFieldName,
+		minInterval: time.Hour,
+		log:         mstatus.Logger(t.Log),
+	}
+	var err error
+	if c.template, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMastodonPost(t *testing.T) {
+	s := &stub{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := newClient(t, ts.URL)
+	c.spoiler = "music"
+	c.hashtags = []string{"#nowplaying", "#music"}
+
+	l := mstatus.Listen{
+		Type:      mstatus.ListenCompleted,
+		StartedAt: time.Now(),
+		Track:     mstatus.Track{Title: "title", Artist: "artist", Album: "album"},
+	}
+	c.handleListen(l)
+	// Within the minimum interval
+	c.handleListen(l)
+
+	if len(s.posts) != 1 {
+		t.Fatalf("got %d posts, want 1", len(s.posts))
+	}
+	expected := url.Values{
+		"status":       {"title by artist from album\n\n#nowplaying #music"},
+		"visibility":   {"unlisted"},
+		"spoiler_text": {"music"},
+	}
+	for k, v := range expected {
+		if got := s.posts[0].Get(k); got != v[0] {
+			t.Errorf("%s got %q, want %q", k, got, v[0])
+		}
+	}
+}
+
+func TestMastodonProfile(t *testing.T) {
+	s := &stub{fields: []field{{Name: "Website", Value: "https://example.com"}}}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := newClient(t, ts.URL)
+	c.mode = modeProfile
+	c.minInterval = 0
+
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+	ch <- mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: "title", Artist: "artist"},
+	}
+	close(ch)
+	<-done
+
+	expected := []field{
+		{Name: "Website", Value: "https://example.com"},
+		{Name: defaultFieldName, Value: "title by artist"},
+	}
+	if len(s.fields) != len(expected) {
+		t.Fatalf("got %v, want %v", s.fields, expected)
+	}
+	for i := range expected {
+		if s.fields[i] != expected[i] {
+			t.Errorf("got %v, want %v", s.fields[i], expected[i])
+		}
+	}
+
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.fields) != 1 || s.fields[0].Name != "Website" {
+		t.Errorf("got %v after stop", s.fields)
+	}
+}
+
+func TestMastodonRateLimit(t *testing.T) {
+	s := &stub{limited: true}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := newClient(t, ts.URL)
+	err := c.post(mstatus.Listen{Track: mstatus.Track{Title: "title"}})
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("got %v, want rate limited", err)
+	}
+	if time.Until(c.blockedUntil) < 59*time.Minute {
+		t.Errorf("blocked until %s", c.blockedUntil)
+	}
+
+	// No request is made while blocked
+	s.limited = false
+	if err := c.post(mstatus.Listen{Track: mstatus.Track{Title: "title"}}); err == nil {
+		t.Error("expected error while blocked")
+	}
+	if s.requests != 1 {
+		t.Errorf("got %d requests, want 1", s.requests)
+	}
+}
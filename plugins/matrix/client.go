@@ -0,0 +1,236 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		expiry:     5 * time.Minute,
+		log:        func(...interface{}) {},
+	})
+}
+
+const (
+	scope           = "matrix"
+	defaultTemplate = `{{if .Track.Artist}}"{{.Track.Title}}" by {{.Track.Artist}}{{else}}"{{.Track.Title}}"{{end}}`
+	presenceOnline  = "online"
+)
+
+// Client sets the Matrix presence status message for the current track and
+// optionally posts each new track to a room.
+type Client struct {
+	homeserver string
+	token      string
+	userID     string
+	roomID     string
+	httpClient *http.Client
+	template   *template.Template
+	log        mstatus.Logger
+
+	// Expiry this duration after the song finishes
+	expiry time.Duration
+	// Status to use when unpublishing
+	defaultStatus string
+
+	// Transaction ID counter for room messages
+	txn int64
+}
+
+var (
+	_ mstatus.Handler    = (*Client)(nil)
+	_ mstatus.ChatStatus = (*Client)(nil)
+)
+
+// presence is the body of the presence API.
+type presence struct {
+	Presence  string `json:"presence"`
+	StatusMsg string `json:"status_msg"`
+}
+
+// message is a room message event.
+type message struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.homeserver = s
+	}
+	if c.homeserver == "" {
+		return fmt.Errorf("missing matrix url")
+	}
+	c.token = sess.ConfigString(scope, "token")
+	if c.token == "" {
+		return fmt.Errorf("missing matrix token")
+	}
+	c.roomID = sess.ConfigString(scope, "room")
+	c.defaultStatus = sess.ConfigString(scope, "defaultStatus")
+	if s := sess.ConfigString(scope, "expireStatus"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.expiry = d
+	}
+	text := defaultTemplate
+	if s := sess.ConfigString(scope, "template"); s != "" {
+		text = s
+	}
+	var err error
+	if c.template, err = mstatus.NewTemplate("text", text); err != nil {
+		return err
+	}
+
+	// The user is only needed for the presence path
+	c.userID = sess.ConfigString(scope, "user")
+	if c.userID == "" {
+		if c.userID, err = c.whoami(); err != nil {
+			return fmt.Errorf("failed to get matrix user: %w", err)
+		}
+	}
+	c.txn = time.Now().UnixNano()
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	// Matrix has no status expiry so it is done locally
+	mstatus.ChatStatusRunner{
+		Expiry:        c.expiry,
+		ExpireLocally: true,
+		Template:      c.template,
+		Errorf:        errorf,
+	}.Run(events, c)
+}
+
+// SetStatus implements mstatus.ChatStatus, also posting to the room if
+// configured.
+func (c *Client) SetStatus(text string, _ time.Time) error {
+	if err := c.setPresence(text); err != nil {
+		return err
+	}
+	if c.roomID != "" {
+		if err := c.send(text); err != nil {
+			return fmt.Errorf("failed to send message: %w", err)
+		}
+	}
+	return nil
+}
+
+// ResetStatus implements mstatus.ChatStatus.
+func (c *Client) ResetStatus() error {
+	return c.setPresence(c.defaultStatus)
+}
+
+func (c *Client) Stop() error {
+	if c.userID == "" {
+		return nil
+	}
+	return c.ResetStatus()
+}
+
+func (c *Client) whoami() (string, error) {
+	var r struct {
+		UserID string `json:"user_id"`
+	}
+	if err := c.do("GET", "/_matrix/client/v3/account/whoami", nil, &r); err != nil {
+		return "", err
+	}
+	if r.UserID == "" {
+		return "", fmt.Errorf("no user id")
+	}
+	return r.UserID, nil
+}
+
+func (c *Client) setPresence(text string) error {
+	endpoint := "/_matrix/client/v3/presence/" + url.PathEscape(c.userID) + "/status"
+	if err := c.do("PUT", endpoint, presence{
+		Presence:  presenceOnline,
+		StatusMsg: text,
+	}, nil); err != nil {
+		return err
+	}
+	if text != "" {
+		c.log("matrix published", text)
+	}
+	return nil
+}
+
+func (c *Client) send(text string) error {
+	c.txn++
+	endpoint := "/_matrix/client/v3/rooms/" + url.PathEscape(c.roomID) +
+		"/send/m.room.message/" + strconv.FormatInt(c.txn, 10)
+	return c.do("PUT", endpoint, message{MsgType: "m.notice", Body: text}, nil)
+}
+
+// do performs a request with a JSON body, decoding the response into out if
+// not nil.
+func (c *Client) do(method, endpoint string, in, out interface{}) error {
+	uri, err := url.JoinPath(c.homeserver, endpoint)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var r struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &r) == nil && r.ErrCode != "" {
+			return fmt.Errorf("matrix request failed: %d %s %s", resp.StatusCode, r.ErrCode, r.Error)
+		}
+		return fmt.Errorf("matrix request failed: %d %q", resp.StatusCode, string(b))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "matrix error: "+format, v...)
+}
@@ -0,0 +1,179 @@
+package matrix
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+// stub is a minimal Matrix homeserver.
+type stub struct {
+	sync.Mutex
+	presence []presence
+	messages []message
+}
+
+func (s *stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token"}`))
+		return
+	}
+	switch {
+	case r.URL.Path == "/_matrix/client/v3/account/whoami":
+		w.Write([]byte(`{"user_id":"@user:example.com"}`))
+	case r.Method == "PUT" && r.URL.Path == "/_matrix/client/v3/presence/@user:example.com/status":
+		var p presence
+		json.NewDecoder(r.Body).Decode(&p)
+		s.presence = append(s.presence, p)
+		w.Write([]byte(`{}`))
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!room:example.com/send/m.room.message/"):
+		var m message
+		json.NewDecoder(r.Body).Decode(&m)
+		s.messages = append(s.messages, m)
+		w.Write([]byte(`{"event_id":"$1"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`))
+	}
+}
+
+func TestMatrixHandle(t *testing.T) {
+	track := mstatus.Track{Title: "title", Artist: "artist", Duration: time.Minute}
+	tests := map[string]struct {
+		statuses []mstatus.Status
+		room     string
+		presence []string
+		messages []string
+	}{
+		"stopped": {
+			statuses: []mstatus.Status{{State: mstatus.StateStopped}},
+		},
+		"play": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+				{State: mstatus.StatePlaying, Track: &track},
+			},
+			presence: []string{`"title" by artist`},
+		},
+		"play then pause": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+				{State: mstatus.StatePaused, Track: &track},
+			},
+			presence: []string{`"title" by artist`, "away"},
+		},
+		"room": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+			},
+			room:     "!room:example.com",
+			presence: []string{`"title" by artist`},
+			messages: []string{`"title" by artist`},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := &stub{}
+			ts := httptest.NewServer(s)
+			defer ts.Close()
+
+			c := &Client{
+				homeserver:    ts.URL,
+				token:         "token",
+				roomID:        tt.room,
+				httpClient:    ts.Client(),
+				expiry:        time.Hour,
+				defaultStatus: "away",
+				log:           mstatus.Logger(t.Log),
+			}
+			var err error
+			if c.template, err = mstatus.NewTemplate("text", defaultTemplate); err != nil {
+				t.Fatal(err)
+			}
+			if c.userID, err = c.whoami(); err != nil {
+				t.Fatal(err)
+			}
+
+			ch := make(chan mstatus.Status)
+			go func() {
+				for _, st := range tt.statuses {
+					ch <- st
+				}
+				close(ch)
+			}()
+			c.Start(ch)
+
+			if len(s.presence) != len(tt.presence) {
+				t.Fatalf("got %v, want %v", s.presence, tt.presence)
+			}
+			for i, p := range s.presence {
+				if p.StatusMsg != tt.presence[i] || p.Presence != presenceOnline {
+					t.Errorf("got %v, want %q", p, tt.presence[i])
+				}
+			}
+			if len(s.messages) != len(tt.messages) {
+				t.Fatalf("got %v, want %v", s.messages, tt.messages)
+			}
+			for i, m := range s.messages {
+				if m.Body != tt.messages[i] || m.MsgType != "m.notice" {
+					t.Errorf("got %v, want %q", m, tt.messages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMatrixExpiry(t *testing.T) {
+	s := &stub{}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := &Client{
+		homeserver:    ts.URL,
+		token:         "token",
+		userID:        "@user:example.com",
+		httpClient:    ts.Client(),
+		expiry:        10 * time.Millisecond,
+		defaultStatus: "away",
+		log:           mstatus.Logger(t.Log),
+	}
+	c.template, _ = mstatus.NewTemplate("text", defaultTemplate)
+
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+	ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &mstatus.Track{Title: "title"}}
+	time.Sleep(100 * time.Millisecond)
+	close(ch)
+	<-done
+
+	s.Lock()
+	defer s.Unlock()
+	if len(s.presence) != 2 || s.presence[1].StatusMsg != "away" {
+		t.Errorf("got %v, want expiry to default status", s.presence)
+	}
+}
+
+func TestMatrixError(t *testing.T) {
+	ts := httptest.NewServer(&stub{})
+	defer ts.Close()
+
+	c := &Client{homeserver: ts.URL, token: "bad", httpClient: ts.Client()}
+	_, err := c.whoami()
+	if err == nil || !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("got %v, want M_UNKNOWN_TOKEN", err)
+	}
+}
@@ -0,0 +1,176 @@
+package mattermost
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		expiry:     5 * time.Minute,
+		emoji:      defaultEmoji,
+		log:        func(...interface{}) {},
+	})
+}
+
+const (
+	scope          = "mattermost"
+	defaultEmoji   = "headphones"
+	customEndpoint = "/api/v4/users/me/status/custom"
+)
+
+// Client sets a Mattermost custom status for the current track.
+type Client struct {
+	apiURL     string
+	token      string
+	httpClient *http.Client
+	log        mstatus.Logger
+
+	// Expiry this duration after the song finishes
+	expiry time.Duration
+	// Emoji to use when unpublishing
+	defaultEmoji string
+	// Status to use when unpublishing, the status is cleared if empty
+	defaultStatus string
+	// Emoji to use for publishing
+	emoji string
+}
+
+var (
+	_ mstatus.Handler    = (*Client)(nil)
+	_ mstatus.ChatStatus = (*Client)(nil)
+)
+
+// customStatus is the structure sent to Mattermost
+type customStatus struct {
+	Emoji     string `json:"emoji"`
+	Text      string `json:"text"`
+	Duration  string `json:"duration,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing mattermost url")
+	}
+	c.token = sess.ConfigString(scope, "token")
+	if c.token == "" {
+		return fmt.Errorf("missing mattermost token")
+	}
+	if s := sess.ConfigString(scope, "expireStatus"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.expiry = d
+	}
+	// Mattermost emoji names have no colons
+	if s := sess.ConfigString(scope, "emoji"); s != "" {
+		c.emoji = strings.Trim(s, ":")
+	}
+	c.defaultEmoji = strings.Trim(sess.ConfigString(scope, "defaultEmoji"), ":")
+	c.defaultStatus = sess.ConfigString(scope, "defaultStatus")
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	mstatus.ChatStatusRunner{
+		Expiry: c.expiry,
+		Errorf: errorf,
+	}.Run(events, c)
+}
+
+// SetStatus implements mstatus.ChatStatus.
+func (c *Client) SetStatus(text string, expires time.Time) error {
+	cs := customStatus{Emoji: c.emoji, Text: text}
+	if !expires.IsZero() {
+		cs.Duration = "date_and_time"
+		cs.ExpiresAt = expires.UTC().Format(time.RFC3339)
+	}
+	if err := c.do("PUT", cs); err != nil {
+		return err
+	}
+	c.log("mattermost published", text)
+	return nil
+}
+
+// ResetStatus implements mstatus.ChatStatus.
+func (c *Client) ResetStatus() error {
+	if c.defaultStatus == "" && c.defaultEmoji == "" {
+		return c.do("DELETE", nil)
+	}
+	return c.do("PUT", customStatus{Emoji: c.defaultEmoji, Text: c.defaultStatus})
+}
+
+func (c *Client) Stop() error {
+	if c.token == "" {
+		return nil
+	}
+	return c.ResetStatus()
+}
+
+func (c *Client) do(method string, cs interface{}) error {
+	uri, err := url.JoinPath(c.apiURL, customEndpoint)
+	if err != nil {
+		return err
+	}
+	var body io.Reader
+	if cs != nil {
+		b, err := json.Marshal(cs)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if cs != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var r struct {
+			ID      string `json:"id"`
+			Message string `json:"message"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(b, &r) == nil && r.Message != "" {
+			return fmt.Errorf("mattermost request failed: %d %s", resp.StatusCode, r.Message)
+		}
+		return fmt.Errorf("mattermost request failed: %d %q", resp.StatusCode, string(b))
+	}
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mattermost error: "+format, v...)
+}
@@ -0,0 +1,127 @@
+package mattermost
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+type request struct {
+	method string
+	status customStatus
+}
+
+func TestMattermostHandle(t *testing.T) {
+	track := mstatus.Track{Title: "title", Artist: "artist", Duration: time.Minute}
+	tests := map[string]struct {
+		statuses      []mstatus.Status
+		defaultStatus string
+		expected      []request
+	}{
+		"play": {
+			statuses: []mstatus.Status{{State: mstatus.StatePlaying, Track: &track}},
+			expected: []request{
+				{"PUT", customStatus{Emoji: defaultEmoji, Text: `"title" by artist`, Duration: "date_and_time"}},
+			},
+		},
+		"play then stop": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+				{State: mstatus.StateStopped},
+			},
+			expected: []request{
+				{"PUT", customStatus{Emoji: defaultEmoji, Text: `"title" by artist`, Duration: "date_and_time"}},
+				{"DELETE", customStatus{}},
+			},
+		},
+		"default status": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+				{State: mstatus.StatePaused, Track: &track},
+			},
+			defaultStatus: "working",
+			expected: []request{
+				{"PUT", customStatus{Emoji: defaultEmoji, Text: `"title" by artist`, Duration: "date_and_time"}},
+				{"PUT", customStatus{Text: "working"}},
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []request
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != customEndpoint || r.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"id":"api.context.session_expired.app_error","message":"Invalid or expired session","status_code":401}`))
+					return
+				}
+				req := request{method: r.Method}
+				if r.Method == "PUT" {
+					if err := json.NewDecoder(r.Body).Decode(&req.status); err != nil {
+						t.Error(err)
+					}
+				}
+				got = append(got, req)
+				w.Write([]byte(`{"status":"OK"}`))
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				apiURL:        ts.URL,
+				token:         "token",
+				httpClient:    ts.Client(),
+				expiry:        time.Minute,
+				emoji:         defaultEmoji,
+				defaultStatus: tt.defaultStatus,
+				log:           mstatus.Logger(t.Log),
+			}
+			ch := make(chan mstatus.Status)
+			go func() {
+				for _, s := range tt.statuses {
+					ch <- s
+				}
+				close(ch)
+			}()
+			c.Start(ch)
+
+			if len(got) != len(tt.expected) {
+				t.Fatalf("got %v, want %v", got, tt.expected)
+			}
+			for i, e := range tt.expected {
+				g := got[i]
+				if e.status.Duration != "" {
+					expires, err := time.Parse(time.RFC3339, g.status.ExpiresAt)
+					if err != nil {
+						t.Fatalf("invalid expires_at: %s", err)
+					}
+					if d := time.Until(expires); d < time.Minute || d > 2*time.Minute {
+						t.Errorf("got expiry in %s", d)
+					}
+					g.status.ExpiresAt = ""
+				}
+				if g != e {
+					t.Errorf("got %v, want %v", g, e)
+				}
+			}
+		})
+	}
+}
+
+func TestMattermostError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"Invalid or expired session","status_code":401}`))
+	}))
+	defer ts.Close()
+
+	c := &Client{apiURL: ts.URL, token: "bad", httpClient: ts.Client(), log: mstatus.Logger(t.Log)}
+	err := c.SetStatus("text", time.Time{})
+	if err == nil || err.Error() != "mattermost request failed: 401 Invalid or expired session" {
+		t.Errorf("got %v", err)
+	}
+}
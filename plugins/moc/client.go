@@ -0,0 +1,172 @@
+package moc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const scope = "moc"
+
+// Client polls the MOC server with mocp -i.
+type Client struct {
+	command  string
+	interval time.Duration
+	timeout  time.Duration
+
+	events chan mstatus.Status
+	log    mstatus.Logger
+	done   chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		command:  "mocp",
+		interval: time.Second,
+		timeout:  5 * time.Second,
+		events:   make(chan mstatus.Status),
+		log:      func(...interface{}) {},
+		done:     make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "command"); s != "" {
+		c.command = s
+	}
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid moc interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+func (c *Client) Watch() error {
+	c.log("moc starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+
+		case <-ticker.C:
+			status := mstatus.Status{
+				State:  mstatus.StateStopped,
+				Player: mstatus.Player{Name: scope},
+			}
+			info, err := c.info()
+			if err != nil {
+				// The server is not running
+				c.log("moc info failed", err)
+				c.events <- status
+				continue
+			}
+			status.State, status.Track = parseInfo(info)
+			c.events <- status
+		}
+	}
+}
+
+// info runs mocp -i, returning its fields.
+func (c *Client) info() (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, c.command, "-i").Output()
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), ":"); ok {
+			fields[k] = strings.TrimSpace(v)
+		}
+	}
+	return fields, scanner.Err()
+}
+
+// parseInfo maps the fields of mocp -i.
+//
+//	State: PLAY
+//	File: /music/01.flac
+//	Title: Eric Clapton - Motherless Children (461 Ocean Boulevard)
+//	Artist: Eric Clapton
+//	SongTitle: Motherless Children
+//	Album: 461 Ocean Boulevard
+//	TotalSec: 292
+//	CurrentSec: 62
+func parseInfo(fields map[string]string) (mstatus.State, *mstatus.Track) {
+	var state mstatus.State
+	switch fields["State"] {
+	case "PLAY":
+		state = mstatus.StatePlaying
+	case "PAUSE":
+		state = mstatus.StatePaused
+	default:
+		return mstatus.StateStopped, nil
+	}
+	file := fields["File"]
+	if file == "" {
+		return mstatus.StateStopped, nil
+	}
+	total, _ := strconv.Atoi(fields["TotalSec"])
+	current, _ := strconv.Atoi(fields["CurrentSec"])
+
+	out := &mstatus.Track{
+		ID:       file,
+		Title:    fields["SongTitle"],
+		Artist:   fields["Artist"],
+		Album:    fields["Album"],
+		Duration: time.Duration(total) * time.Second,
+		Elapsed:  time.Duration(current) * time.Second,
+		URI:      file,
+	}
+	// Title is formatted from the tags, or is the stream or file name
+	if out.Title == "" {
+		out.Title = fields["Title"]
+	}
+	// Each track announced by a stream is a separate play
+	if strings.Contains(file, "://") {
+		out.ID = file + "#" + fields["Title"]
+	}
+	if out.Title == "" {
+		out.Title = filepath.Base(file)
+	}
+	if out.Artist != "" {
+		out.Artists = []string{out.Artist}
+	}
+	return state, out
+}
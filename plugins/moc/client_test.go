@@ -0,0 +1,118 @@
+package moc
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const infoOutput = `State: PLAY
+File: /music/01.flac
+Title: Eric Clapton - Motherless Children (461 Ocean Boulevard)
+Artist: Eric Clapton
+SongTitle: Motherless Children
+Album: 461 Ocean Boulevard
+TotalTime: 04:52
+TimeLeft: 03:50
+TotalSec: 292
+CurrentTime: 01:02
+CurrentSec: 62
+Bitrate: 1411kbps
+AvgBitrate: 1411kbps
+Rate: 44kHz
+`
+
+func TestMocInfo(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "mocp")
+	script := "#!/bin/sh\n[ \"$1\" = -i ] || exit 2\ncat <<'EOF'\n" + infoOutput + "EOF\n"
+	if err := os.WriteFile(command, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{command: command, timeout: time.Second}
+	info, err := c.info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, got := parseInfo(info)
+	if state != mstatus.StatePlaying {
+		t.Errorf("got state %q", state)
+	}
+	expected := &mstatus.Track{
+		ID:       "/music/01.flac",
+		Title:    "Motherless Children",
+		Artist:   "Eric Clapton",
+		Artists:  []string{"Eric Clapton"},
+		Album:    "461 Ocean Boulevard",
+		Duration: 292 * time.Second,
+		Elapsed:  62 * time.Second,
+		URI:      "/music/01.flac",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	// The server is not running
+	if err := os.WriteFile(command, []byte("#!/bin/sh\necho 'FATAL_ERROR: The server is not running!' >&2\nexit 2\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.info(); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestMocParseInfo(t *testing.T) {
+	tests := map[string]struct {
+		fields map[string]string
+		state  mstatus.State
+		title  string
+		id     string
+	}{
+		"stopped": {
+			fields: map[string]string{"State": "STOP"},
+			state:  mstatus.StateStopped,
+		},
+		"paused": {
+			fields: map[string]string{"State": "PAUSE", "File": "/music/01.flac", "SongTitle": "title"},
+			state:  mstatus.StatePaused,
+			title:  "title",
+		},
+		"stream": {
+			fields: map[string]string{"State": "PLAY", "File": "http://radio.example.com/live", "Title": "Radio"},
+			state:  mstatus.StatePlaying,
+			title:  "Radio",
+			id:     "http://radio.example.com/live#Radio",
+		},
+		"untagged": {
+			fields: map[string]string{"State": "PLAY", "File": "/music/01.flac"},
+			state:  mstatus.StatePlaying,
+			title:  "01.flac",
+			id:     "/music/01.flac",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			state, track := parseInfo(tt.fields)
+			if state != tt.state {
+				t.Errorf("got state %q, want %q", state, tt.state)
+			}
+			if tt.title == "" {
+				if track != nil {
+					t.Errorf("got track %#v", track)
+				}
+				return
+			}
+			if track == nil || track.Title != tt.title {
+				t.Errorf("got track %#v, want title %q", track, tt.title)
+			}
+			if track != nil && tt.id != "" && track.ID != tt.id {
+				t.Errorf("got ID %q, want %q", track.ID, tt.id)
+			}
+		})
+	}
+}
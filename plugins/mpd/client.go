@@ -29,6 +29,9 @@ type Client struct {
 	done chan struct{}
 }
 
+var _ mstatus.Source = (*Client)(nil)
+var _ mstatus.ArtworkFetcher = (*Client)(nil)
+
 func init() {
 	mstatus.Register(&Client{
 		addr:   "localhost:6600",
@@ -154,6 +157,10 @@ func (c *Client) Watch() error {
 			return nil
 
 		case <-ticker.C:
+			if c.conn != nil {
+				// The protocol version from the connection banner
+				status.Player.Version = c.conn.Version()
+			}
 			status.Track, err = c.fetchSong()
 			if err == nil && status.Track != nil {
 				status.State = mstatus.StatePlaying
@@ -246,18 +253,76 @@ func (c *Client) fetchSong() (*mstatus.Track, error) {
 		elapsed = time.Duration(secs * float64(time.Second))
 	}
 	//fmt.Printf("%s became duration %s and elapsed %s\n", stat["time"], duration, elapsed)
-	return &mstatus.Track{
-		ID:          song["Id"],
-		Title:       song["Title"],
-		Artist:      song["Artist"],
-		Album:       song["Album"],
-		Duration:    duration,
-		Elapsed:     elapsed,
-		MbTrackID:   song["MUSICBRAINZ_TRACKID"], // recording ID
-		MbReleaseID: song["MUSICBRAINZ_ALBUMID"], // album ID
-		MbArtistID:  song["MUSICBRAINZ_ARTISTID"],
-		// MUSICBRAINZ_WORKID:4a484ba1-22d4-4fd1-a29a-b1c49d1e5161
-	}, nil
+	out := &mstatus.Track{
+		ID:               song["Id"],
+		Title:            song["Title"],
+		Artist:           song["Artist"],
+		Album:            song["Album"],
+		AlbumArtist:      song["AlbumArtist"],
+		TrackNumber:      mstatus.ParseNumber(song["Track"]),
+		DiscNumber:       mstatus.ParseNumber(song["Disc"]),
+		ReleaseDate:      song["Date"],
+		Duration:         duration,
+		Elapsed:          elapsed,
+		MbTrackID:        song["MUSICBRAINZ_TRACKID"], // recording ID
+		MbReleaseID:      song["MUSICBRAINZ_ALBUMID"], // album ID
+		MbArtistID:       song["MUSICBRAINZ_ARTISTID"],
+		MbReleaseTrackID: song["MUSICBRAINZ_RELEASETRACKID"],
+		MbReleaseGroupID: song["MUSICBRAINZ_RELEASEGROUPID"],
+		MbWorkID:         song["MUSICBRAINZ_WORKID"],
+		ISRC:             song["ISRC"],
+		URI:              song["file"],
+	}
+	if out.Artist != "" {
+		out.Artists = []string{out.Artist}
+	}
+	if s := song["Genre"]; s != "" {
+		out.Tags = []string{s}
+	}
+	return out, nil
+}
+
+// FetchArtwork reads the picture embedded in the file, falling back to the
+// cover image in its directory. It uses its own connection as the watcher
+// may replace the shared one at any time.
+func (c *Client) FetchArtwork(t *mstatus.Track) ([]byte, error) {
+	if t.URI == "" {
+		return nil, nil
+	}
+	conn, err := gompd.DialAuthenticated("tcp", c.addr, c.password)
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	defer conn.Close()
+	if data, err := readPicture(conn, t.URI); err == nil && len(data) > 0 {
+		return data, nil
+	}
+	data, err := conn.AlbumArt(t.URI)
+	if err != nil {
+		// MPD responds with an error if there is no cover
+		c.log("mpd no albumart", t.URI, err)
+		return nil, nil
+	}
+	return data, nil
+}
+
+// readPicture implements the readpicture command, which is not provided by
+// gompd.
+func readPicture(conn *gompd.Client, uri string) ([]byte, error) {
+	var data []byte
+	for {
+		chunk, size, err := conn.Command("readpicture %s %d", uri, len(data)).Binary()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		if len(chunk) == 0 || len(data) >= size {
+			return data, nil
+		}
+	}
 }
 
 func errorf(format string, v ...interface{}) {
@@ -0,0 +1,353 @@
+package mpv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const scope = "mpv"
+
+// properties are observed with their index as the ID.
+var properties = []string{
+	"pause", "media-title", "metadata", "duration", "time-pos", "path",
+	"mpv-version",
+}
+
+// Client follows mpv instances through their IPC sockets.
+type Client struct {
+	// Glob of socket paths, given to mpv with --input-ipc-server
+	socket   string
+	interval time.Duration
+
+	mu      sync.Mutex
+	players map[string]*player
+	// Running follow goroutines
+	wg sync.WaitGroup
+
+	// changed receives a value when a player changes
+	changed chan struct{}
+	events  chan mstatus.Status
+	log     mstatus.Logger
+	done    chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		socket:   "/tmp/mpvsocket*",
+		interval: 5 * time.Second,
+		players:  make(map[string]*player),
+		changed:  make(chan struct{}, 1),
+		events:   make(chan mstatus.Status),
+		log:      func(...interface{}) {},
+		done:     make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "socket"); s != "" {
+		if rest, ok := strings.CutPrefix(s, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return err
+			}
+			s = filepath.Join(home, rest)
+		}
+		c.socket = s
+	}
+	if _, err := filepath.Match(c.socket, ""); err != nil {
+		return fmt.Errorf("invalid mpv socket %q: %w", c.socket, err)
+	}
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid mpv interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+// Watch emits the status when a player changes, and on the interval to
+// update the elapsed time. Sockets are found again on the interval so
+// restarted players are followed.
+func (c *Client) Watch() error {
+	c.log("mpv starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	c.connect()
+	for {
+		select {
+		case <-c.done:
+			c.mu.Lock()
+			for _, p := range c.players {
+				p.conn.Close()
+			}
+			c.mu.Unlock()
+			c.wg.Wait()
+			return nil
+
+		case <-c.changed:
+			c.events <- c.status()
+
+		case <-ticker.C:
+			c.connect()
+			c.events <- c.status()
+		}
+	}
+}
+
+// connect connects to sockets matching the glob that are not followed.
+func (c *Client) connect() {
+	paths, _ := filepath.Glob(c.socket)
+	for _, path := range paths {
+		c.mu.Lock()
+		_, ok := c.players[path]
+		c.mu.Unlock()
+		if ok {
+			continue
+		}
+		// Sockets are left behind when mpv exits
+		conn, err := net.DialTimeout("unix", path, time.Second)
+		if err != nil {
+			continue
+		}
+		c.log("mpv connected", path)
+		p := &player{socket: path, conn: conn, metadata: map[string]string{}}
+		c.mu.Lock()
+		c.players[path] = p
+		c.mu.Unlock()
+		c.wg.Add(1)
+		go c.follow(p)
+	}
+}
+
+// player is the observed state of an mpv instance.
+type player struct {
+	socket     string
+	conn       net.Conn
+	version    string
+	paused     bool
+	mediaTitle string
+	metadata   map[string]string
+	duration   float64
+	timePos    float64
+	path       string
+}
+
+// event is a message from mpv, only property changes are used.
+type event struct {
+	Event string          `json:"event"`
+	ID    int             `json:"id"`
+	Name  string          `json:"name"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// follow observes the player's properties until the connection closes.
+func (c *Client) follow(p *player) {
+	defer func() {
+		defer c.wg.Done()
+		p.conn.Close()
+		c.mu.Lock()
+		delete(c.players, p.socket)
+		c.mu.Unlock()
+		c.log("mpv disconnected", p.socket)
+		c.notify()
+	}()
+
+	for i, name := range properties {
+		b, _ := json.Marshal(map[string]interface{}{
+			"command": []interface{}{"observe_property", i + 1, name},
+		})
+		if _, err := p.conn.Write(append(b, '\n')); err != nil {
+			return
+		}
+	}
+
+	scanner := bufio.NewScanner(p.conn)
+	// Metadata can be large
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var ev event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil || ev.Event != "property-change" {
+			continue
+		}
+		c.mu.Lock()
+		p.update(ev.Name, ev.Data)
+		c.mu.Unlock()
+		// The position changes constantly and is read on the interval
+		if ev.Name != "time-pos" {
+			c.notify()
+		}
+	}
+}
+
+func (c *Client) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// update sets a property, data is null when it is unavailable.
+func (p *player) update(name string, data json.RawMessage) {
+	switch name {
+	case "pause":
+		p.paused = false
+		json.Unmarshal(data, &p.paused)
+	case "media-title":
+		p.mediaTitle = ""
+		json.Unmarshal(data, &p.mediaTitle)
+	case "metadata":
+		var m map[string]string
+		json.Unmarshal(data, &m)
+		// Tag names vary by format, for example MUSICBRAINZ_TRACKID and
+		// "MusicBrainz Track Id"
+		p.metadata = make(map[string]string, len(m))
+		for k, v := range m {
+			p.metadata[normalize(k)] = v
+		}
+	case "duration":
+		p.duration = 0
+		json.Unmarshal(data, &p.duration)
+	case "time-pos":
+		p.timePos = 0
+		json.Unmarshal(data, &p.timePos)
+	case "path":
+		p.path = ""
+		json.Unmarshal(data, &p.path)
+	case "mpv-version":
+		json.Unmarshal(data, &p.version)
+	}
+}
+
+func normalize(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '-' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(key))
+}
+
+// status reports the first playing instance, or else a paused one.
+func (c *Client) status() mstatus.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var current *player
+	for _, p := range c.players {
+		if p.path == "" {
+			continue
+		}
+		if current == nil || (current.paused && !p.paused) ||
+			// Order is stable between updates
+			(current.paused == p.paused && p.socket < current.socket) {
+			current = p
+		}
+	}
+	if current == nil {
+		return mstatus.Status{
+			State:  mstatus.StateStopped,
+			Player: mstatus.Player{Name: scope},
+		}
+	}
+	out := mstatus.Status{
+		State:  mstatus.StatePlaying,
+		Player: mstatus.Player{Name: scope, Version: strings.TrimPrefix(current.version, "mpv ")},
+		Track:  current.track(),
+	}
+	if current.paused {
+		out.State = mstatus.StatePaused
+	}
+	return out
+}
+
+func (p *player) track() *mstatus.Track {
+	m := p.metadata
+	out := &mstatus.Track{
+		ID:               p.path,
+		Title:            m["title"],
+		Artist:           m["artist"],
+		Album:            m["album"],
+		AlbumArtist:      m["albumartist"],
+		TrackNumber:      mstatus.ParseNumber(m["track"]),
+		DiscNumber:       mstatus.ParseNumber(m["disc"]),
+		ReleaseDate:      m["date"],
+		Duration:         seconds(p.duration),
+		Elapsed:          seconds(p.timePos),
+		MbTrackID:        m["musicbrainztrackid"],
+		MbReleaseID:      m["musicbrainzalbumid"],
+		MbArtistID:       m["musicbrainzartistid"],
+		MbReleaseTrackID: m["musicbrainzreleasetrackid"],
+		MbReleaseGroupID: m["musicbrainzreleasegroupid"],
+		MbWorkID:         m["musicbrainzworkid"],
+		ISRC:             m["isrc"],
+		URI:              p.path,
+	}
+	if out.TrackNumber == 0 {
+		out.TrackNumber = mstatus.ParseNumber(m["tracknumber"])
+	}
+	if out.DiscNumber == 0 {
+		out.DiscNumber = mstatus.ParseNumber(m["discnumber"])
+	}
+	// Streams announce "Artist - Title"
+	if out.Title == "" && m["icytitle"] != "" {
+		artist, title, ok := strings.Cut(m["icytitle"], " - ")
+		if ok && out.Artist == "" {
+			out.Artist, out.Title = artist, title
+		} else {
+			out.Title = m["icytitle"]
+		}
+	}
+	// The file name if there are no tags
+	if out.Title == "" {
+		out.Title = p.mediaTitle
+	}
+	// Each track announced by a stream is a separate play
+	if s := m["icytitle"]; s != "" {
+		out.ID = p.path + "#" + s
+	} else if strings.Contains(p.path, "://") && p.mediaTitle != "" {
+		out.ID = p.path + "#" + p.mediaTitle
+	}
+	if out.Artist != "" {
+		out.Artists = []string{out.Artist}
+	}
+	if s := m["genre"]; s != "" {
+		out.Tags = []string{s}
+	}
+	return out
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
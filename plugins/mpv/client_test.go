@@ -0,0 +1,223 @@
+package mpv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func TestMpvTrack(t *testing.T) {
+	p := &player{}
+	for name, data := range map[string]string{
+		"path":        `"/music/01.mp3"`,
+		"media-title": `"01.mp3"`,
+		"pause":       `false`,
+		"duration":    `292.5`,
+		"time-pos":    `62.25`,
+		"metadata": `{"title":"Motherless Children","artist":"Eric Clapton","album":"461 Ocean Boulevard",
+			"album_artist":"Eric Clapton","track":"1/10","disc":"1/1","date":"1974","genre":"Rock",
+			"MusicBrainz Track Id":"10aae51f-f253-42c4-8af8-5673da1c98e6",
+			"MusicBrainz Album Id":"2089dcff-a209-49c4-8bbe-d43328c6efed",
+			"MUSICBRAINZ_ARTISTID":"618b6900-0618-4f1e-b835-bccb17f84294"}`,
+	} {
+		p.update(name, json.RawMessage(data))
+	}
+	expected := &mstatus.Track{
+		ID:          "/music/01.mp3",
+		Title:       "Motherless Children",
+		Artist:      "Eric Clapton",
+		Artists:     []string{"Eric Clapton"},
+		Album:       "461 Ocean Boulevard",
+		AlbumArtist: "Eric Clapton",
+		TrackNumber: 1,
+		DiscNumber:  1,
+		ReleaseDate: "1974",
+		Tags:        []string{"Rock"},
+		Duration:    292500 * time.Millisecond,
+		Elapsed:     62250 * time.Millisecond,
+		MbTrackID:   "10aae51f-f253-42c4-8af8-5673da1c98e6",
+		MbReleaseID: "2089dcff-a209-49c4-8bbe-d43328c6efed",
+		MbArtistID:  "618b6900-0618-4f1e-b835-bccb17f84294",
+		URI:         "/music/01.mp3",
+	}
+	if got := p.track(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	// Streams
+	p.update("metadata", json.RawMessage(`{"icy-title":"Eric Clapton - Layla","icy-name":"Radio"}`))
+	p.update("duration", json.RawMessage(`null`))
+	got := p.track()
+	if got.Title != "Layla" || got.Artist != "Eric Clapton" || got.Duration != 0 {
+		t.Errorf("got %#v", got)
+	}
+
+	// Files without tags
+	p.update("metadata", json.RawMessage(`{}`))
+	if got := p.track(); got.Title != "01.mp3" || got.Artist != "" {
+		t.Errorf("got %#v", got)
+	}
+}
+
+func TestMpvStreamListens(t *testing.T) {
+	p := &player{}
+	p.update("path", json.RawMessage(`"http://radio.example.com/stream"`))
+	p.update("media-title", json.RawMessage(`"Radio"`))
+
+	// Streams report no position so listening is timed
+	tracker := mstatus.NewListenTracker(mstatus.ListenRule{})
+	var got []string
+	record := func(listens []mstatus.Listen) {
+		for _, l := range listens {
+			if l.Type == mstatus.ListenCompleted {
+				got = append(got, l.Track.Title)
+			}
+		}
+	}
+	for _, icy := range []string{"Eric Clapton - Layla", "Eric Clapton - Cocaine"} {
+		p.update("metadata", json.RawMessage(fmt.Sprintf(`{"icy-title":%q}`, icy)))
+		for i := 0; i < 2; i++ {
+			record(tracker.Update(mstatus.Status{State: mstatus.StatePlaying, Track: p.track()}))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	record(tracker.Flush())
+
+	expected := []string{"Layla", "Cocaine"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got listens %q, want %q", got, expected)
+	}
+}
+
+// stub is an mpv instance reporting fixed properties.
+type stub struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func startStub(t *testing.T, path string, props map[string]string) *stub {
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &stub{ln: ln}
+	t.Cleanup(s.close)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conn = conn
+		s.mu.Unlock()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var cmd struct {
+				Command []interface{} `json:"command"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil || len(cmd.Command) != 3 || cmd.Command[0] != "observe_property" {
+				t.Errorf("got command %s", scanner.Text())
+				continue
+			}
+			name := cmd.Command[2].(string)
+			data, ok := props[name]
+			if !ok {
+				data = "null"
+			}
+			fmt.Fprintf(conn, `{"request_id":0,"error":"success"}`+"\n")
+			fmt.Fprintf(conn, `{"event":"property-change","id":%v,"name":%q,"data":%s}`+"\n", cmd.Command[1], name, data)
+		}
+	}()
+	return s
+}
+
+// close exits the instance.
+func (s *stub) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func waitFor(t *testing.T, c *Client, desc string, fn func(mstatus.Status) bool) {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case s := <-c.events:
+			if fn(s) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+	}
+}
+
+func TestMpvWatch(t *testing.T) {
+	dir := t.TempDir()
+	startStub(t, filepath.Join(dir, "a.sock"), map[string]string{
+		"path":        `"/music/a.flac"`,
+		"media-title": `"a"`,
+		"pause":       `true`,
+	})
+	playing := map[string]string{
+		"path":        `"/music/b.flac"`,
+		"media-title": `"b"`,
+		"pause":       `false`,
+		"mpv-version": `"mpv 0.38.0"`,
+	}
+	b := startStub(t, filepath.Join(dir, "b.sock"), playing)
+
+	c := &Client{
+		socket:   filepath.Join(dir, "*.sock"),
+		interval: 20 * time.Millisecond,
+		players:  make(map[string]*player),
+		changed:  make(chan struct{}, 1),
+		events:   make(chan mstatus.Status),
+		log:      mstatus.Logger(t.Log),
+		done:     make(chan struct{}),
+	}
+	watching := make(chan struct{})
+	go func() {
+		c.Watch()
+		close(watching)
+	}()
+	defer func() {
+		c.Stop()
+		for {
+			select {
+			case <-c.events:
+			case <-watching:
+				return
+			}
+		}
+	}()
+
+	waitFor(t, c, "playing instance", func(s mstatus.Status) bool {
+		return s.State == mstatus.StatePlaying && s.Track.Title == "b" && s.Player.Version == "0.38.0"
+	})
+
+	// Falls back to the paused instance when mpv exits
+	b.close()
+	waitFor(t, c, "paused instance", func(s mstatus.Status) bool {
+		return s.State == mstatus.StatePaused && s.Track.Title == "a"
+	})
+
+	// and reconnects when it restarts
+	startStub(t, filepath.Join(dir, "b.sock"), playing)
+	waitFor(t, c, "restarted instance", func(s mstatus.Status) bool {
+		return s.State == mstatus.StatePlaying && s.Track.Title == "b"
+	})
+}
@@ -0,0 +1,453 @@
+package musicbrainz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		apiURL:     defaultURL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		interval:   defaultInterval,
+		minScore:   defaultMinScore,
+		cache:      make(map[string]result),
+		log:        func(...interface{}) {},
+	})
+}
+
+const (
+	scope      = "musicbrainz"
+	defaultURL = "https://musicbrainz.org/ws/2"
+	cacheFile  = "recordings.json"
+	// MusicBrainz allows an average of one request per second
+	// https://musicbrainz.org/doc/MusicBrainz_API/Rate_Limiting
+	defaultInterval = time.Second
+	defaultMinScore = 90
+	// Failed lookups are retried after this long, or Retry-After if later
+	failureBackoff = 5 * time.Minute
+	// Lookups waiting for the worker, more are tried on a later status
+	queueSize = 16
+)
+
+// Client looks up MusicBrainz identifiers for tracks.
+type Client struct {
+	apiURL     string
+	httpClient *http.Client
+	log        mstatus.Logger
+
+	// Replace identifiers provided by the source
+	overwrite bool
+	// Minimum search score to accept a recording
+	minScore int
+	// Minimum time between requests
+	interval time.Duration
+
+	// Lookups run in the background so Enrich never waits on the network
+	startOnce sync.Once
+	stopOnce  sync.Once
+	queue     chan mstatus.Track
+	done      chan struct{}
+	// Lookups queued or running, those queued at Stop are dropped
+	pending sync.WaitGroup
+
+	mu        sync.Mutex
+	stopped   bool
+	cachePath string
+	cache     map[string]result
+	// Keys queued for lookup
+	inflight map[string]bool
+	// Keys that failed and when to try them again
+	retryAt map[string]time.Time
+
+	// Used only by the worker
+	lastRequest  time.Time
+	blockedUntil time.Time
+}
+
+var _ mstatus.Enricher = (*Client)(nil)
+
+// result is the cached outcome of a lookup. An empty result records that
+// nothing was found.
+type result struct {
+	RecordingID string `json:"recording_id,omitempty"`
+	ReleaseID   string `json:"release_id,omitempty"`
+	ArtistID    string `json:"artist_id,omitempty"`
+}
+
+type recording struct {
+	ID           string `json:"id"`
+	Score        int    `json:"score"`
+	Title        string `json:"title"`
+	ArtistCredit []struct {
+		Name   string `json:"name"`
+		Artist struct {
+			ID string `json:"id"`
+		} `json:"artist"`
+	} `json:"artist-credit"`
+	Releases []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+	} `json:"releases"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	c.overwrite = sess.ConfigBool(scope, "overwrite")
+	if i := sess.ConfigInt(scope, "minScore"); i > 0 {
+		c.minScore = i
+	}
+
+	dir := sess.ConfigString(scope, "cacheDir")
+	if dir == "" {
+		var err error
+		if dir, err = mstatus.CacheDir(scope); err != nil {
+			return err
+		}
+	}
+	c.cachePath = path.Join(dir, cacheFile)
+	return c.loadCache()
+}
+
+func (c *Client) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	if c.done != nil {
+		c.stopOnce.Do(func() { close(c.done) })
+	}
+	return c.saveCache()
+}
+
+// Enrich fills in missing MusicBrainz identifiers, searching by ISRC if
+// available and falling back to artist, title and album. Tracks not yet
+// cached are looked up in the background and enriched on a later status.
+func (c *Client) Enrich(t *mstatus.Track) error {
+	if !c.overwrite && t.MbTrackID != "" && t.MbReleaseID != "" && t.MbArtistID != "" {
+		return nil
+	}
+	key := cacheKey(t)
+	if key == "" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.cache[key]
+	if !ok {
+		c.enqueue(key, t)
+		return nil
+	}
+
+	set := func(dst *string, v string) {
+		if v != "" && (c.overwrite || *dst == "") {
+			*dst = v
+		}
+	}
+	set(&t.MbTrackID, r.RecordingID)
+	set(&t.MbReleaseID, r.ReleaseID)
+	set(&t.MbArtistID, r.ArtistID)
+	return nil
+}
+
+// enqueue queues a lookup unless one is queued or it recently failed. The
+// lock must be held.
+func (c *Client) enqueue(key string, t *mstatus.Track) {
+	if c.stopped {
+		return
+	}
+	if c.inflight[key] || time.Now().Before(c.retryAt[key]) {
+		return
+	}
+	c.startOnce.Do(c.start)
+	select {
+	case c.queue <- *t:
+		c.inflight[key] = true
+		c.pending.Add(1)
+	default:
+	}
+}
+
+func (c *Client) start() {
+	c.queue = make(chan mstatus.Track, queueSize)
+	c.done = make(chan struct{})
+	c.inflight = make(map[string]bool)
+	c.retryAt = make(map[string]time.Time)
+	go c.run()
+}
+
+// run performs lookups until stopped.
+func (c *Client) run() {
+	for {
+		select {
+		case <-c.done:
+			// Nothing is queued once stopped, drop what remains
+			for {
+				select {
+				case <-c.queue:
+					c.pending.Done()
+				default:
+					return
+				}
+			}
+		case t := <-c.queue:
+			c.resolve(t)
+			c.pending.Done()
+		}
+	}
+}
+
+// resolve looks up t and caches the result, or when to retry on failure.
+func (c *Client) resolve(t mstatus.Track) {
+	key := cacheKey(&t)
+	r, err := c.lookup(&t)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	if err != nil {
+		wait := failureBackoff
+		var se *StatusError
+		if errors.As(err, &se) && se.RetryAfter > wait {
+			wait = se.RetryAfter
+		}
+		c.retryAt[key] = time.Now().Add(wait)
+		c.log("musicbrainz lookup failed, retrying in", wait, err)
+		return
+	}
+	delete(c.retryAt, key)
+	c.log("musicbrainz found", t, r.RecordingID)
+	c.cache[key] = r
+	if err := c.saveCache(); err != nil {
+		c.log("failed to save cache", err)
+	}
+}
+
+func cacheKey(t *mstatus.Track) string {
+	if t.ISRC != "" {
+		return "isrc:" + strings.ToUpper(t.ISRC)
+	}
+	if t.Title == "" || t.Artist == "" {
+		return ""
+	}
+	return strings.ToLower(strings.Join([]string{"search", t.Artist, t.Title, t.Album}, "\x1f"))
+}
+
+func (c *Client) lookup(t *mstatus.Track) (result, error) {
+	if t.ISRC != "" {
+		var resp struct {
+			Recordings []recording `json:"recordings"`
+		}
+		err := c.get("isrc/"+url.PathEscape(t.ISRC), url.Values{"inc": {"artist-credits releases"}}, &resp)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return result{}, err
+		}
+		if len(resp.Recordings) > 0 {
+			return newResult(resp.Recordings[0], t.Album), nil
+		}
+		if t.Title == "" || t.Artist == "" {
+			return result{}, nil
+		}
+	}
+
+	q := []string{
+		"recording:" + quote(t.Title),
+		"artist:" + quote(t.Artist),
+	}
+	if t.Album != "" {
+		q = append(q, "release:"+quote(t.Album))
+	}
+	var resp struct {
+		Recordings []recording `json:"recordings"`
+	}
+	err := c.get("recording", url.Values{
+		"query": {strings.Join(q, " AND ")},
+		"limit": {"5"},
+	}, &resp)
+	if err != nil {
+		return result{}, err
+	}
+	for _, rec := range resp.Recordings {
+		if rec.Score >= c.minScore {
+			return newResult(rec, t.Album), nil
+		}
+	}
+	return result{}, nil
+}
+
+// newResult prefers the release matching album, otherwise the first.
+func newResult(rec recording, album string) result {
+	out := result{RecordingID: rec.ID}
+	if len(rec.ArtistCredit) > 0 {
+		out.ArtistID = rec.ArtistCredit[0].Artist.ID
+	}
+	for _, rel := range rec.Releases {
+		if strings.EqualFold(rel.Title, album) {
+			out.ReleaseID = rel.ID
+			return out
+		}
+	}
+	if len(rec.Releases) > 0 {
+		out.ReleaseID = rec.Releases[0].ID
+	}
+	return out
+}
+
+var (
+	errNotFound = errors.New("not found")
+	errStopped  = errors.New("stopped")
+)
+
+// StatusError is an unexpected response status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is from the Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("musicbrainz request failed: %d %q", e.StatusCode, e.Body)
+}
+
+func (c *Client) get(endpoint string, params url.Values, v any) error {
+	uri, err := url.JoinPath(c.apiURL, endpoint)
+	if err != nil {
+		return err
+	}
+	params.Set("fmt", "json")
+	req, err := http.NewRequest("GET", uri+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "application/json")
+
+	if !c.wait() {
+		return errStopped
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		se := &StatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+		}
+		// Rate limited or unavailable, pause all requests
+		if se.StatusCode == http.StatusTooManyRequests || se.StatusCode == http.StatusServiceUnavailable {
+			wait := se.RetryAfter
+			if wait <= 0 {
+				wait = time.Minute
+			}
+			c.blockedUntil = time.Now().Add(wait)
+		}
+		return se
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// wait blocks until the next request is allowed, returning false if
+// stopped meanwhile.
+func (c *Client) wait() bool {
+	next := c.lastRequest.Add(c.interval)
+	if c.blockedUntil.After(next) {
+		next = c.blockedUntil
+	}
+	if d := time.Until(next); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.done:
+			return false
+		}
+	}
+	c.lastRequest = time.Now()
+	return true
+}
+
+// retryAfter parses a Retry-After header in seconds or as a date.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func (c *Client) loadCache() error {
+	f, err := os.Open(c.cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := json.NewDecoder(f).Decode(&c.cache); err != nil {
+		c.log("invalid cache", c.cachePath, err)
+	}
+	return nil
+}
+
+func (c *Client) saveCache() error {
+	if c.cachePath == "" {
+		return nil
+	}
+	b, err := json.Marshal(c.cache)
+	if err != nil {
+		return err
+	}
+	return mstatus.WriteFileAtomic(c.cachePath, b, 0644)
+}
+
+// userAgent identifies the application as MusicBrainz requires.
+// https://musicbrainz.org/doc/MusicBrainz_API/Rate_Limiting#Provide_meaningful_User-Agent_strings
+func userAgent() string {
+	return mstatus.ClientName + "/" + mstatus.Version() + " ( " + mstatus.ClientURL + " )"
+}
+
+// quote a Lucene search term.
+func quote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,302 @@
+package musicbrainz
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const recordingJSON = `{
+	"id": "rec-1",
+	"score": %d,
+	"title": "Motherless Children",
+	"artist-credit": [{"name": "Eric Clapton", "artist": {"id": "artist-1"}}],
+	"releases": [
+		{"id": "rel-other", "title": "Crossroads"},
+		{"id": "rel-1", "title": "461 Ocean Boulevard"}
+	]
+}`
+
+func TestMusicBrainzEnrich(t *testing.T) {
+	tests := map[string]struct {
+		track     mstatus.Track
+		overwrite bool
+		score     int
+		want      mstatus.Track
+		requests  int
+	}{
+		"isrc": {
+			track: mstatus.Track{ISRC: "GBF077420010"},
+			want: mstatus.Track{
+				ISRC:        "GBF077420010",
+				MbTrackID:   "rec-1",
+				MbReleaseID: "rel-other",
+				MbArtistID:  "artist-1",
+			},
+			requests: 1,
+		},
+		"search": {
+			track: mstatus.Track{Title: "Motherless Children", Artist: "Eric Clapton", Album: "461 Ocean Boulevard"},
+			score: 100,
+			want: mstatus.Track{
+				Title:       "Motherless Children",
+				Artist:      "Eric Clapton",
+				Album:       "461 Ocean Boulevard",
+				MbTrackID:   "rec-1",
+				MbReleaseID: "rel-1",
+				MbArtistID:  "artist-1",
+			},
+			requests: 1,
+		},
+		"low score": {
+			track:    mstatus.Track{Title: "Motherless Children", Artist: "Eric Clapton"},
+			score:    50,
+			want:     mstatus.Track{Title: "Motherless Children", Artist: "Eric Clapton"},
+			requests: 1,
+		},
+		"complete": {
+			track:    mstatus.Track{Title: "t", Artist: "a", MbTrackID: "x", MbReleaseID: "y", MbArtistID: "z"},
+			want:     mstatus.Track{Title: "t", Artist: "a", MbTrackID: "x", MbReleaseID: "y", MbArtistID: "z"},
+			requests: 0,
+		},
+		"keep existing": {
+			track: mstatus.Track{ISRC: "GBF077420010", MbReleaseID: "artist-1"},
+			want: mstatus.Track{
+				ISRC:        "GBF077420010",
+				MbTrackID:   "rec-1",
+				MbReleaseID: "artist-1",
+				MbArtistID:  "artist-1",
+			},
+			requests: 1,
+		},
+		"overwrite": {
+			track:     mstatus.Track{ISRC: "GBF077420010", MbReleaseID: "artist-1"},
+			overwrite: true,
+			want: mstatus.Track{
+				ISRC:        "GBF077420010",
+				MbTrackID:   "rec-1",
+				MbReleaseID: "rel-other",
+				MbArtistID:  "artist-1",
+			},
+			requests: 1,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var requests int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if r.Header.Get("User-Agent") == "" {
+					t.Errorf("missing user agent")
+				}
+				switch path.Dir(r.URL.Path) {
+				case "/isrc":
+					fmt.Fprintf(w, `{"recordings":[`+recordingJSON+`]}`, 0)
+				case "/":
+					fmt.Fprintf(w, `{"recordings":[`+recordingJSON+`]}`, tt.score)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				apiURL:     ts.URL,
+				httpClient: ts.Client(),
+				log:        mstatus.Logger(t.Log),
+				overwrite:  tt.overwrite,
+				minScore:   defaultMinScore,
+				cachePath:  path.Join(t.TempDir(), cacheFile),
+				cache:      make(map[string]result),
+			}
+
+			// Looked up in the background
+			got := tt.track
+			if err := c.Enrich(&got); err != nil {
+				t.Fatal(err)
+			}
+			c.pending.Wait()
+
+			// Later statuses are enriched from the cache
+			for i := 0; i < 2; i++ {
+				got := tt.track
+				if err := c.Enrich(&got); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("\ngot  %#v\nwant %#v", got, tt.want)
+				}
+			}
+			if requests != tt.requests {
+				t.Errorf("got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestMusicBrainzCache(t *testing.T) {
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"recordings":[`+recordingJSON+`]}`, 100)
+	}))
+	defer ts.Close()
+
+	cachePath := path.Join(t.TempDir(), cacheFile)
+	newClient := func() *Client {
+		c := &Client{
+			apiURL:     ts.URL,
+			httpClient: ts.Client(),
+			log:        mstatus.Logger(t.Log),
+			minScore:   defaultMinScore,
+			interval:   50 * time.Millisecond,
+			cachePath:  cachePath,
+			cache:      make(map[string]result),
+		}
+		if err := c.loadCache(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	start := time.Now()
+	for _, title := range []string{"one", "two"} {
+		if err := c.Enrich(&mstatus.Track{Title: title, Artist: "artist"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.pending.Wait()
+	if d := time.Since(start); d < c.interval {
+		t.Errorf("requests not rate limited, took %s", d)
+	}
+	if requests != 2 {
+		t.Fatalf("got %d requests, want 2", requests)
+	}
+
+	// A new client should use the saved cache
+	c = newClient()
+	tr := mstatus.Track{Title: "One", Artist: "Artist"}
+	if err := c.Enrich(&tr); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+	if tr.MbTrackID != "rec-1" {
+		t.Errorf("got %q, want %q", tr.MbTrackID, "rec-1")
+	}
+}
+
+func TestMusicBrainzFailure(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"error":"rate limited"}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		log:        mstatus.Logger(t.Log),
+		minScore:   defaultMinScore,
+		cache:      make(map[string]result),
+	}
+	defer c.Stop()
+
+	// Enrich does not wait for the server
+	tr := mstatus.Track{Title: "one", Artist: "artist"}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := c.Enrich(&tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("enrich blocked for %s", d)
+	}
+	close(release)
+	c.pending.Wait()
+
+	// Failures are not retried until Retry-After
+	for i := 0; i < 3; i++ {
+		if err := c.Enrich(&tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.pending.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+	c.mu.Lock()
+	retry := time.Until(c.retryAt[cacheKey(&tr)])
+	c.mu.Unlock()
+	if retry < 59*time.Minute {
+		t.Errorf("got retry in %s, want an hour", retry)
+	}
+	if time.Until(c.blockedUntil) < 59*time.Minute {
+		t.Errorf("requests not paused")
+	}
+}
+
+func TestMusicBrainzStop(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		log:        mstatus.Logger(t.Log),
+		minScore:   defaultMinScore,
+		cache:      make(map[string]result),
+	}
+	for _, title := range []string{"one", "two", "three"} {
+		if err := c.Enrich(&mstatus.Track{Title: title, Artist: "artist"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	// Queued lookups are dropped rather than left pending
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookups still pending after stop")
+	}
+	if err := c.Enrich(&mstatus.Track{Title: "four", Artist: "artist"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.queue) != 0 {
+		t.Errorf("queued %d lookups after stop", len(c.queue))
+	}
+}
@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+
+	"github.com/godbus/dbus/v5"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		timeout: -1,
+		log:     func(...interface{}) {},
+	})
+}
+
+const (
+	scope           = "notify"
+	appName         = "music-status"
+	defaultIcon     = "audio-x-generic"
+	defaultSummary  = `{{.Track.Title}}`
+	defaultBody     = `{{.Track.Artist}}{{if .Track.Album}} - {{.Track.Album}}{{end}}`
+	notifyDest      = "org.freedesktop.Notifications"
+	notifyPath      = "/org/freedesktop/Notifications"
+	notifyInterface = "org.freedesktop.Notifications"
+)
+
+// Client shows a desktop notification for each new track using the
+// freedesktop Notifications service on the session bus. Each notification
+// replaces the previous one.
+type Client struct {
+	// Bus address, defaults to the session bus
+	address string
+	conn    *dbus.Conn
+	summary *template.Template
+	body    *template.Template
+	// Expiry in milliseconds, -1 for the server default
+	timeout int32
+	log     mstatus.Logger
+
+	// ID of the last notification, to be replaced
+	id uint32
+}
+
+var _ mstatus.Handler = (*Client)(nil)
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	c.address = sess.ConfigString(scope, "bus")
+
+	summary := defaultSummary
+	if s := sess.ConfigString(scope, "summary"); s != "" {
+		summary = s
+	}
+	var err error
+	if c.summary, err = mstatus.NewTemplate("summary", summary); err != nil {
+		return err
+	}
+	body := defaultBody
+	if s := sess.ConfigString(scope, "body"); s != "" {
+		body = s
+	}
+	if c.body, err = mstatus.NewTemplate("body", body); err != nil {
+		return err
+	}
+	if i := sess.ConfigInt(scope, "timeout"); i != 0 {
+		c.timeout = int32(i)
+	}
+	return c.connect()
+}
+
+func (c *Client) connect() error {
+	var err error
+	if c.address == "" {
+		c.conn, err = dbus.ConnectSessionBus()
+	} else {
+		c.conn, err = dbus.Connect(c.address)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to bus: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	var last string
+	for event := range events {
+		switch event.State {
+		case mstatus.StatePlaying:
+			if event.Track == nil {
+				continue
+			}
+			key := event.Track.ID + event.Track.String()
+			if key == last {
+				continue
+			}
+			last = key
+			if err := c.notify(event); err != nil {
+				errorf("failed to notify: %s\n", err)
+			}
+
+		case mstatus.StatePaused:
+			// Suppressed, resuming the same track does not notify again
+
+		default:
+			last = ""
+		}
+	}
+}
+
+func (c *Client) notify(s mstatus.Status) error {
+	summary, err := mstatus.ExecuteTemplate(c.summary, s)
+	if err != nil {
+		return err
+	}
+	body, err := mstatus.ExecuteTemplate(c.body, s)
+	if err != nil {
+		return err
+	}
+
+	icon := defaultIcon
+	hints := map[string]dbus.Variant{
+		"category":  dbus.MakeVariant("x-music-status.track"),
+		"transient": dbus.MakeVariant(true),
+	}
+	if p := s.Track.ArtworkPath; p != "" {
+		icon = "file://" + p
+		hints["image-path"] = dbus.MakeVariant(icon)
+	}
+
+	obj := c.conn.Object(notifyDest, notifyPath)
+	call := obj.Call(notifyInterface+".Notify", 0,
+		appName,
+		c.id,
+		icon,
+		summary,
+		body,
+		[]string{},
+		hints,
+		c.timeout,
+	)
+	if call.Err != nil {
+		return call.Err
+	}
+	if err := call.Store(&c.id); err != nil {
+		return err
+	}
+	c.log("notify published", summary)
+	return nil
+}
+
+func (c *Client) Stop() error {
+	if c.conn == nil {
+		return nil
+	}
+	if c.id != 0 {
+		obj := c.conn.Object(notifyDest, notifyPath)
+		if call := obj.Call(notifyInterface+".CloseNotification", 0, c.id); call.Err != nil {
+			c.log("failed to close notification", call.Err)
+		}
+	}
+	return c.conn.Close()
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "notify error: "+format, v...)
+}
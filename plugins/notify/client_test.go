@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/godbus/dbus/v5"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+// startBus runs a private dbus-daemon, returning its address.
+func startBus(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--print-address=1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(addr)
+}
+
+type notification struct {
+	replaces uint32
+	icon     string
+	summary  string
+	body     string
+}
+
+// fakeDaemon implements the notification server.
+type fakeDaemon struct {
+	mu     sync.Mutex
+	calls  []notification
+	closed []uint32
+}
+
+func (d *fakeDaemon) Notify(app string, replaces uint32, icon, summary, body string, actions []string, hints map[string]dbus.Variant, timeout int32) (uint32, *dbus.Error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, notification{replaces, icon, summary, body})
+	if replaces != 0 {
+		return replaces, nil
+	}
+	return uint32(len(d.calls)), nil
+}
+
+func (d *fakeDaemon) CloseNotification(id uint32) *dbus.Error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = append(d.closed, id)
+	return nil
+}
+
+func TestNotify(t *testing.T) {
+	addr := startBus(t)
+
+	server, err := dbus.Connect(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	daemon := &fakeDaemon{}
+	if err := server.Export(daemon, notifyPath, notifyInterface); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := server.RequestName(notifyDest, dbus.NameFlagDoNotQueue); err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("failed to own name: %v %v", reply, err)
+	}
+
+	c := &Client{
+		address: addr,
+		summary: template.Must(mstatus.NewTemplate("summary", defaultSummary)),
+		body:    template.Must(mstatus.NewTemplate("body", defaultBody)),
+		timeout: -1,
+		log:     mstatus.Logger(t.Log),
+	}
+	if err := c.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	first := &mstatus.Track{ID: "1", Title: "first", Artist: "artist", Album: "album", ArtworkPath: "/tmp/cover.jpg"}
+	second := &mstatus.Track{ID: "2", Title: "second", Artist: "artist"}
+
+	ch := make(chan mstatus.Status)
+	go func() {
+		ch <- mstatus.Status{State: mstatus.StatePlaying, Track: first}
+		ch <- mstatus.Status{State: mstatus.StatePlaying, Track: first}
+		ch <- mstatus.Status{State: mstatus.StatePaused, Track: first}
+		ch <- mstatus.Status{State: mstatus.StatePlaying, Track: first}
+		// Some sources report playing before the track is known
+		ch <- mstatus.Status{State: mstatus.StatePlaying}
+		ch <- mstatus.Status{State: mstatus.StatePlaying, Track: second}
+		close(ch)
+	}()
+	c.Start(ch)
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	want := []notification{
+		{0, "file:///tmp/cover.jpg", "first", "artist - album"},
+		{1, defaultIcon, "second", "artist"},
+	}
+	if len(daemon.calls) != len(want) {
+		t.Fatalf("got %d notifications %v, want %d", len(daemon.calls), daemon.calls, len(want))
+	}
+	for i := range want {
+		if daemon.calls[i] != want[i] {
+			t.Errorf("got %#v, want %#v", daemon.calls[i], want[i])
+		}
+	}
+	if len(daemon.closed) != 1 || daemon.closed[0] != 1 {
+		t.Errorf("got closed %v, want [1]", daemon.closed)
+	}
+}
@@ -0,0 +1,160 @@
+package rocketchat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func init() {
+	mstatus.Register(&Client{
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		expiry:     5 * time.Minute,
+		presence:   "online",
+		log:        func(...interface{}) {},
+	})
+}
+
+const (
+	scope          = "rocketchat"
+	statusEndpoint = "/api/v1/users.setStatus"
+)
+
+// Client sets the Rocket.Chat status message for the current track.
+type Client struct {
+	apiURL     string
+	token      string
+	userID     string
+	httpClient *http.Client
+	log        mstatus.Logger
+
+	// Expiry this duration after the song finishes
+	expiry time.Duration
+	// Status to use when unpublishing
+	defaultStatus string
+	// Presence sent with each status, one of online, away, busy
+	presence string
+}
+
+var (
+	_ mstatus.Handler    = (*Client)(nil)
+	_ mstatus.ChatStatus = (*Client)(nil)
+)
+
+// setStatus is the structure sent to Rocket.Chat
+type setStatus struct {
+	Message string `json:"message"`
+	Status  string `json:"status"`
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing rocketchat url")
+	}
+	c.token = sess.ConfigString(scope, "token")
+	c.userID = sess.ConfigString(scope, "user")
+	if c.token == "" || c.userID == "" {
+		return fmt.Errorf("missing rocketchat token or user")
+	}
+	if s := sess.ConfigString(scope, "expireStatus"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.expiry = d
+	}
+	if s := sess.ConfigString(scope, "presence"); s != "" {
+		c.presence = s
+	}
+	c.defaultStatus = sess.ConfigString(scope, "defaultStatus")
+	return nil
+}
+
+func (c *Client) Start(events <-chan mstatus.Status) {
+	// Rocket.Chat has no status expiry so it is done locally
+	mstatus.ChatStatusRunner{
+		Expiry:        c.expiry,
+		ExpireLocally: true,
+		Errorf:        errorf,
+	}.Run(events, c)
+}
+
+// SetStatus implements mstatus.ChatStatus.
+func (c *Client) SetStatus(text string, _ time.Time) error {
+	if err := c.setStatus(text); err != nil {
+		return err
+	}
+	c.log("rocketchat published", text)
+	return nil
+}
+
+// ResetStatus implements mstatus.ChatStatus.
+func (c *Client) ResetStatus() error {
+	return c.setStatus(c.defaultStatus)
+}
+
+func (c *Client) Stop() error {
+	if c.token == "" {
+		return nil
+	}
+	return c.ResetStatus()
+}
+
+func (c *Client) setStatus(text string) error {
+	uri, err := url.JoinPath(c.apiURL, statusEndpoint)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(setStatus{Message: text, Status: c.presence})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", c.token)
+	req.Header.Set("X-User-Id", c.userID)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("rocketchat request failed: %d %q", resp.StatusCode, string(body))
+	}
+	if !r.Success {
+		return fmt.Errorf("rocketchat request failed: %d %s", resp.StatusCode, r.Error)
+	}
+	return nil
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "rocketchat error: "+format, v...)
+}
@@ -0,0 +1,92 @@
+package rocketchat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+func TestRocketchatHandle(t *testing.T) {
+	track := mstatus.Track{Title: "title", Artist: "artist"}
+	tests := map[string]struct {
+		statuses []mstatus.Status
+		expected []string
+	}{
+		"play": {
+			statuses: []mstatus.Status{{State: mstatus.StatePlaying, Track: &track}},
+			expected: []string{`"title" by artist`},
+		},
+		"play then stop": {
+			statuses: []mstatus.Status{
+				{State: mstatus.StatePlaying, Track: &track},
+				{State: mstatus.StateStopped},
+			},
+			expected: []string{`"title" by artist`, "away from keyboard"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != statusEndpoint || r.Header.Get("X-Auth-Token") != "token" || r.Header.Get("X-User-Id") != "user" {
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"status":"error","message":"You must be logged in to do this."}`))
+					return
+				}
+				var s setStatus
+				if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+					t.Error(err)
+				}
+				if s.Status != "online" {
+					t.Errorf("got presence %q", s.Status)
+				}
+				got = append(got, s.Message)
+				w.Write([]byte(`{"success":true}`))
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				apiURL:        ts.URL,
+				token:         "token",
+				userID:        "user",
+				httpClient:    ts.Client(),
+				expiry:        time.Hour,
+				presence:      "online",
+				defaultStatus: "away from keyboard",
+				log:           mstatus.Logger(t.Log),
+			}
+			ch := make(chan mstatus.Status)
+			go func() {
+				for _, s := range tt.statuses {
+					ch <- s
+				}
+				close(ch)
+			}()
+			c.Start(ch)
+
+			if strings.Join(got, "|") != strings.Join(tt.expected, "|") {
+				t.Errorf("got %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRocketchatError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"success":false,"error":"Invalid status"}`))
+	}))
+	defer ts.Close()
+
+	c := &Client{apiURL: ts.URL, token: "token", userID: "user", httpClient: ts.Client(), log: mstatus.Logger(t.Log)}
+	err := c.SetStatus("text", time.Time{})
+	if err == nil || !strings.Contains(err.Error(), "Invalid status") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -3,12 +3,16 @@ package slack
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"src.userspace.com.au/felix/mstatus"
@@ -17,27 +21,63 @@ import (
 func init() {
 	mstatus.Register(&Client{
 		apiURL:     defaultURL,
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Timeout: 10 * time.Second},
 		expiry:     time.Duration(5 * time.Minute),
+		interval:   defaultInterval,
 		emoji:      defaultEmoji,
 		log:        func(...interface{}) {},
 	})
 }
 
+var (
+	_ mstatus.ChatStatus          = (*Client)(nil)
+	_ mstatus.ChatStatusRefresher = (*Client)(nil)
+)
+
 type Client struct {
-	token      string
+	// One for each workspace
+	workspaces []*workspace
+	// Held while updating the workspaces so Stop cannot overlap the runner
+	mu sync.Mutex
+	// Track status to publish while the user is available, nil if reset
+	desired    *payload
 	apiURL     string
 	httpClient *http.Client
 	log        mstatus.Logger
 
 	// Expiry this number of seconds after the song finishes
 	expiry time.Duration
+	// Minimum time between updates
+	interval time.Duration
 	// Emoji to use when unpublishing
 	defaultEmoji string
 	// Status to use when unpublishing
 	defaultStatus string
 	// Emoji to use for publishing
 	emoji string
+	// Restore the status found at startup instead of the default
+	restore bool
+	// Only publish while the user is active
+	checkPresence bool
+	// Only publish while the user is not in do not disturb
+	checkDND bool
+	// Do not overwrite a status the user set
+	preserveManual bool
+}
+
+// workspace is a Slack workspace, identified by its token.
+type workspace struct {
+	token string
+	// Status found at startup
+	previous *payload
+	// Status last written
+	written *payload
+	// Whether written is a track status
+	playing bool
+	// Requests are not made until this time after being rate limited
+	blockedUntil time.Time
+	// Set once the token is rejected
+	disabled bool
 }
 
 // payload is the structure sent to Slack
@@ -52,20 +92,84 @@ func (p payload) String() string {
 }
 
 const (
-	scope        = "slack"
-	defaultURL   = "https://api.slack.com"
-	slackAction  = "users.profile.set"
-	defaultEmoji = ":musical_note:"
+	scope           = "slack"
+	defaultURL      = "https://api.slack.com"
+	slackAction     = "users.profile.set"
+	slackGetAction  = "users.profile.get"
+	presenceAction  = "users.getPresence"
+	dndAction       = "dnd.info"
+	defaultEmoji    = ":musical_note:"
+	defaultInterval = 10 * time.Second
+	// Used when a 429 response has no Retry-After
+	defaultRetryAfter = time.Minute
 )
 
+// ErrAuth is matched by errors for tokens that are invalid or revoked and
+// will not succeed if retried.
+var ErrAuth = errors.New("slack authentication failed")
+
+// authErrors are Slack error codes for unusable tokens.
+var authErrors = map[string]bool{
+	"not_authed":       true,
+	"invalid_auth":     true,
+	"account_inactive": true,
+	"token_revoked":    true,
+	"token_expired":    true,
+	"no_permission":    true,
+	"missing_scope":    true,
+}
+
+// APIError is a failure reported by the Slack API.
+type APIError struct {
+	Method string
+	Code   string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("slack %s failed: %s", e.Method, e.Code)
+}
+
+// Is matches ErrAuth for authentication failures.
+func (e *APIError) Is(target error) bool {
+	return target == ErrAuth && authErrors[e.Code]
+}
+
+// RateLimitError is returned when Slack rate limits a request.
+type RateLimitError struct {
+	Method string
+	Wait   time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("slack %s rate limited, retry after %s", e.Method, e.Wait)
+}
+
+// RetryAfter implements mstatus.RetryAfter.
+func (e *RateLimitError) RetryAfter() time.Duration {
+	return e.Wait
+}
+
+// StatusError is returned for unexpected HTTP responses.
+type StatusError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("slack %s failed: HTTP %d", e.Method, e.StatusCode)
+}
+
 func (c *Client) Name() string {
 	return scope
 }
 
 func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
 	c.log = log
-	if s := sess.ConfigString(scope, "token"); s != "" {
-		c.token = s
+	// Multiple workspaces are separated by commas
+	for _, t := range strings.Split(sess.ConfigString(scope, "token"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.workspaces = append(c.workspaces, &workspace{token: t})
+		}
 	}
 	if s := sess.ConfigString(scope, "url"); s != "" {
 		if !strings.HasPrefix(s, "http") {
@@ -80,6 +184,13 @@ func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
 		}
 		c.expiry = d
 	}
+	if s := sess.ConfigString(scope, "minInterval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		c.interval = d
+	}
 	if s := sess.ConfigString(scope, "defaultEmoji"); s != "" {
 		c.defaultEmoji = s
 	}
@@ -89,104 +200,314 @@ func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
 	if s := sess.ConfigString(scope, "emoji"); s != "" {
 		c.emoji = s
 	}
-	if c.token == "" {
+	if len(c.workspaces) == 0 {
 		return fmt.Errorf("missing slack token")
 	}
 
+	c.restore = sess.ConfigBool(scope, "restoreStatus")
+	c.checkPresence = sess.ConfigBool(scope, "checkPresence")
+	c.checkDND = sess.ConfigBool(scope, "checkDnd")
+	c.preserveManual = sess.ConfigBool(scope, "preserveManual")
+	if c.restore {
+		for i, w := range c.workspaces {
+			p, err := c.getStatus(w)
+			if err != nil {
+				return fmt.Errorf("failed to get status for workspace %d: %w", i+1, err)
+			}
+			w.previous = p
+		}
+	}
 	return nil
 }
 
 func (c *Client) Start(events <-chan mstatus.Status) {
-	var lastStatus string
-	for event := range events {
-		switch event.State {
-		case mstatus.StateError, mstatus.StateStopped, mstatus.StatePaused:
-			if lastStatus == "" {
-				continue
-			}
-			lastStatus = ""
-			if err := c.setStatus(payload{
-				StatusText:       c.defaultStatus,
-				StatusEmoji:      c.defaultEmoji,
-				StatusExpiration: 0,
-			}); err != nil {
-				errorf("failed to set status: %s", err)
-			}
+	mstatus.ChatStatusRunner{
+		Expires:  c.expires,
+		Interval: c.interval,
+		Errorf:   errorf,
+	}.Run(events, c)
+}
 
-		case mstatus.StatePlaying:
-			s := event.Track
-			if lastStatus == s.String() {
-				continue
-			}
+// expires is the track's full duration plus the configured expiry from
+// now, or none if the expiry is not set.
+func (c *Client) expires(t *mstatus.Track) time.Time {
+	if c.expiry <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.expiry).Add(t.Duration)
+}
 
-			var expiry int64
-			if c.expiry > 0 {
-				expiry += time.Now().Add(c.expiry).Add(s.Duration).Unix()
-			}
+// SetStatus implements mstatus.ChatStatus. A workspace whose user is
+// unavailable has its track status reset instead.
+func (c *Client) SetStatus(text string, expires time.Time) error {
+	var expiry int64
+	if !expires.IsZero() {
+		expiry = expires.Unix()
+	}
+	emoji := c.emoji
+	if emoji == "" {
+		emoji = defaultEmoji
+	}
+	p := payload{
+		StatusText:       text,
+		StatusEmoji:      emoji,
+		StatusExpiration: expiry,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.desired = &p
+	return c.publish(p, true)
+}
+
+// RefreshStatus implements mstatus.ChatStatusRefresher, clearing the track
+// status when the user becomes unavailable and publishing it again when
+// they return.
+func (c *Client) RefreshStatus() error {
+	if !c.checkPresence && !c.checkDND {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.desired == nil {
+		return nil
+	}
+	p := *c.desired
+	if p.StatusExpiration != 0 && p.StatusExpiration <= time.Now().Unix() {
+		return nil
+	}
+	return c.publish(p, false)
+}
 
-			lastStatus = s.String()
-			if err := c.setStatus(payload{
-				StatusText:       lastStatus,
-				StatusEmoji:      c.emoji,
-				StatusExpiration: expiry,
-			}); err != nil {
-				errorf("failed to set status: %s", err)
+// publish writes p to each workspace whose user is available, resetting the
+// track status of the others. Unless force is set, workspaces already
+// showing a track are left alone.
+func (c *Client) publish(p payload, force bool) error {
+	return c.eachWorkspace(true, func(w *workspace) (*payload, error) {
+		ok, err := c.available(w)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if !w.playing {
+				if force {
+					c.log("slack user unavailable, not publishing")
+				}
+				return nil, nil
 			}
-		default:
-			c.log("slack unhandled state", event)
+			c.log("slack user unavailable, clearing status")
+			return nil, c.write(w, c.resetPayload(w), false)
 		}
-	}
+		if w.playing && !force {
+			return nil, nil
+		}
+		return &p, nil
+	})
 }
 
-func (c *Client) Stop() error {
-	return c.setStatus(payload{
+// ResetStatus implements mstatus.ChatStatus, restoring the status found at
+// startup if enabled.
+func (c *Client) ResetStatus() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.desired = nil
+	return c.eachWorkspace(false, func(w *workspace) (*payload, error) {
+		p := c.resetPayload(w)
+		return &p, nil
+	})
+}
+
+func (c *Client) resetPayload(w *workspace) payload {
+	if c.restore && w.previous != nil {
+		p := *w.previous
+		if p.StatusExpiration == 0 || p.StatusExpiration > time.Now().Unix() {
+			return p
+		}
+	}
+	return payload{
 		StatusText:       c.defaultStatus,
 		StatusEmoji:      c.defaultEmoji,
 		StatusExpiration: 0,
-	})
+	}
 }
 
-func (c *Client) setStatus(p payload) error {
-	uri, err := url.JoinPath(c.apiURL, slackAction)
-	if err != nil {
+func (c *Client) Stop() error {
+	return c.ResetStatus()
+}
+
+// eachWorkspace writes the payload returned by fn to each usable workspace,
+// skipping those where it returns nil. Workspaces with rejected tokens are
+// disabled. It is called with c.mu held.
+func (c *Client) eachWorkspace(playing bool, fn func(*workspace) (*payload, error)) error {
+	var errs []error
+	for i, w := range c.workspaces {
+		if w.disabled {
+			continue
+		}
+		p, err := fn(w)
+		if err == nil && p != nil {
+			err = c.write(w, *p, playing)
+		}
+		if errors.Is(err, ErrAuth) {
+			w.disabled = true
+			err = fmt.Errorf("%w, workspace %d disabled", err, i+1)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// write sets the status unless the user has set their own.
+func (c *Client) write(w *workspace, p payload, playing bool) error {
+	if c.preserveManual {
+		current, err := c.getStatus(w)
+		if err != nil {
+			return err
+		}
+		if isManual(current, w.written) {
+			c.log("slack status set manually, not overwriting", current)
+			return nil
+		}
+	}
+	if err := c.setStatus(w, p); err != nil {
 		return err
 	}
+	w.written = &p
+	w.playing = playing
+	return nil
+}
+
+// isManual reports whether current was set by someone other than the
+// handler, which last wrote written.
+func isManual(current, written *payload) bool {
+	if current.StatusText == "" && current.StatusEmoji == "" {
+		return false
+	}
+	if written == nil {
+		return true
+	}
+	// Slack escapes some characters
+	return html.UnescapeString(current.StatusText) != written.StatusText ||
+		current.StatusEmoji != written.StatusEmoji
+}
+
+// available reports whether the user is active and not in do not disturb,
+// for the enabled checks.
+func (c *Client) available(w *workspace) (bool, error) {
+	if c.checkPresence {
+		var r struct {
+			Presence string `json:"presence"`
+		}
+		if err := c.call(w, "GET", presenceAction, nil, &r); err != nil {
+			return false, err
+		}
+		if r.Presence != "active" {
+			return false, nil
+		}
+	}
+	if c.checkDND {
+		var r struct {
+			DNDEnabled    bool  `json:"dnd_enabled"`
+			NextStart     int64 `json:"next_dnd_start_ts"`
+			NextEnd       int64 `json:"next_dnd_end_ts"`
+			SnoozeEnabled bool  `json:"snooze_enabled"`
+		}
+		if err := c.call(w, "GET", dndAction, nil, &r); err != nil {
+			return false, err
+		}
+		now := time.Now().Unix()
+		if r.SnoozeEnabled || (r.DNDEnabled && now >= r.NextStart && now < r.NextEnd) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *Client) setStatus(w *workspace, p payload) error {
 	buf := &bytes.Buffer{}
 	enc := json.NewEncoder(buf)
 	if err := enc.Encode(map[string]payload{"profile": p}); err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", uri, buf)
+	if err := c.call(w, "POST", slackAction, buf, nil); err != nil {
+		return err
+	}
+	if p.StatusText != "" {
+		c.log("slack published", p)
+	}
+	return nil
+}
+
+// getStatus returns the current status of the workspace user.
+func (c *Client) getStatus(w *workspace) (*payload, error) {
+	var r struct {
+		Profile payload `json:"profile"`
+	}
+	if err := c.call(w, "GET", slackGetAction, nil, &r); err != nil {
+		return nil, err
+	}
+	return &r.Profile, nil
+}
+
+// call performs an API method, decoding a successful response into out if
+// not nil.
+func (c *Client) call(w *workspace, httpMethod, method string, body io.Reader, out interface{}) error {
+	if wait := time.Until(w.blockedUntil); wait > 0 {
+		return &RateLimitError{Method: method, Wait: wait}
+	}
+	uri, err := url.JoinPath(c.apiURL, method)
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req, err := http.NewRequest(httpMethod, uri, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", w.token))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	}
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if p.StatusText != "" {
-		c.log("slack published", p)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		wait := defaultRetryAfter
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			wait = time.Duration(s) * time.Second
+		}
+		w.blockedUntil = time.Now().Add(wait)
+		return &RateLimitError{Method: method, Wait: wait}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Method: method, StatusCode: resp.StatusCode}
 	}
 
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
 	var r = struct {
 		OK      bool   `json:"ok"`
 		Warning string `json:"warning"`
 		Error   string `json:"error"`
 	}{}
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		c.log("failed to read body", err)
-	}
-	if err := json.Unmarshal(body, &r); err != nil {
-		c.log("slack invalid response", err, string(body))
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("slack %s invalid response: %w", method, err)
 	}
 	if !r.OK {
-		c.log("slack failure", r.Warning, r.Error)
+		return &APIError{Method: method, Code: r.Error}
 	}
-	return nil
+	if r.Warning != "" {
+		c.log("slack warning", method, r.Warning)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
 }
 
 func errorf(format string, v ...interface{}) {
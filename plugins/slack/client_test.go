@@ -2,9 +2,11 @@ package slack
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -75,9 +77,9 @@ func TestSlackHandle(t *testing.T) {
 			defer ts.Close()
 
 			c := &Client{
-				token:  "token",
-				apiURL: ts.URL,
-				log:    mstatus.Logger(t.Log),
+				workspaces: []*workspace{{token: "token"}},
+				apiURL:     ts.URL,
+				log:        mstatus.Logger(t.Log),
 			}
 			c.httpClient = ts.Client()
 
@@ -98,5 +100,350 @@ func TestSlackHandle(t *testing.T) {
 			}
 		})
 	}
+}
+
+func TestSlackExpiry(t *testing.T) {
+	var pl map[string]payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			t.Errorf("failed to decode %s", err)
+		}
+		fmt.Fprintln(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		workspaces: []*workspace{{token: "token"}},
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		expiry:     5 * time.Minute,
+		log:        mstatus.Logger(t.Log),
+	}
+	ch := make(chan mstatus.Status, 1)
+	ch <- mstatus.Status{
+		State: mstatus.StatePlaying,
+		Track: &mstatus.Track{Title: "title", Duration: 90 * time.Second, Elapsed: time.Minute},
+	}
+	close(ch)
+	c.Start(ch)
+
+	// The full duration is added regardless of the elapsed time
+	want := time.Now().Add(5*time.Minute + 90*time.Second).Unix()
+	if got := pl["profile"].StatusExpiration; got < want-2 || got > want {
+		t.Errorf("got expiration %d, want %d", got, want)
+	}
+}
+
+func TestSlackErrors(t *testing.T) {
+	tests := map[string]struct {
+		status  int
+		header  map[string]string
+		body    string
+		check   func(error) bool
+		disable bool
+	}{
+		"rate limited": {
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"Retry-After": "30"},
+			check: func(err error) bool {
+				var rl *RateLimitError
+				return errors.As(err, &rl) && rl.RetryAfter() == 30*time.Second
+			},
+		},
+		"revoked": {
+			status:  http.StatusOK,
+			body:    `{"ok":false,"error":"token_revoked"}`,
+			check:   func(err error) bool { return errors.Is(err, ErrAuth) },
+			disable: true,
+		},
+		"other": {
+			status: http.StatusOK,
+			body:   `{"ok":false,"error":"too_long"}`,
+			check: func(err error) bool {
+				var ae *APIError
+				return errors.As(err, &ae) && ae.Code == "too_long" && !errors.Is(err, ErrAuth)
+			},
+		},
+		"server error": {
+			status: http.StatusInternalServerError,
+			check: func(err error) bool {
+				var se *StatusError
+				return errors.As(err, &se) && se.StatusCode == 500
+			},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var requests int
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprintln(w, tt.body)
+			}))
+			defer ts.Close()
+
+			ws := &workspace{token: "token"}
+			c := &Client{
+				workspaces: []*workspace{ws},
+				apiURL:     ts.URL,
+				httpClient: ts.Client(),
+				log:        mstatus.Logger(t.Log),
+			}
+			err := c.SetStatus("text", time.Time{})
+			if !tt.check(err) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if ws.disabled != tt.disable {
+				t.Errorf("got disabled %t, want %t", ws.disabled, tt.disable)
+			}
+
+			// Blocked and disabled workspaces make no requests
+			c.SetStatus("text", time.Time{})
+			if tt.disable || tt.status == http.StatusTooManyRequests {
+				if requests != 1 {
+					t.Errorf("got %d requests, want 1", requests)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackRestore(t *testing.T) {
+	previous := payload{StatusText: "in a meeting", StatusEmoji: ":calendar:"}
+	var got []payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + slackGetAction:
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "profile": previous})
+		case "/" + slackAction:
+			var pl map[string]payload
+			if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+				t.Error(err)
+			}
+			got = append(got, pl["profile"])
+			fmt.Fprintln(w, `{"ok":true}`)
+		}
+	}))
+	defer ts.Close()
+
+	ws := &workspace{token: "token"}
+	c := &Client{
+		workspaces: []*workspace{ws},
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		emoji:      defaultEmoji,
+		restore:    true,
+		log:        mstatus.Logger(t.Log),
+	}
+	var err error
+	if ws.previous, err = c.getStatus(ws); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetStatus("playing", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].StatusText != "playing" || got[1] != previous {
+		t.Errorf("got %v, want previous status restored", got)
+	}
+}
 
+func TestSlackAvailability(t *testing.T) {
+	now := time.Now().Unix()
+	tests := map[string]struct {
+		presence       string
+		dnd            string
+		current        payload
+		preserveManual bool
+		expected       []string
+	}{
+		"active": {
+			presence: "active",
+			dnd:      `{"ok":true,"dnd_enabled":false}`,
+			expected: []string{"playing", ""},
+		},
+		"away": {
+			presence: "away",
+			dnd:      `{"ok":true,"dnd_enabled":false}`,
+			expected: []string{""},
+		},
+		"snoozed": {
+			presence: "active",
+			dnd:      `{"ok":true,"snooze_enabled":true}`,
+			expected: []string{""},
+		},
+		"scheduled dnd": {
+			presence: "active",
+			dnd:      fmt.Sprintf(`{"ok":true,"dnd_enabled":true,"next_dnd_start_ts":%d,"next_dnd_end_ts":%d}`, now-60, now+60),
+			expected: []string{""},
+		},
+		"dnd later": {
+			presence: "active",
+			dnd:      fmt.Sprintf(`{"ok":true,"dnd_enabled":true,"next_dnd_start_ts":%d,"next_dnd_end_ts":%d}`, now+60, now+120),
+			expected: []string{"playing", ""},
+		},
+		"manual status": {
+			presence:       "active",
+			dnd:            `{"ok":true}`,
+			current:        payload{StatusText: "In a meeting", StatusEmoji: ":calendar:"},
+			preserveManual: true,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			current := tt.current
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/" + presenceAction:
+					fmt.Fprintf(w, `{"ok":true,"presence":%q}`, tt.presence)
+				case "/" + dndAction:
+					fmt.Fprintln(w, tt.dnd)
+				case "/" + slackGetAction:
+					json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "profile": current})
+				case "/" + slackAction:
+					var pl map[string]payload
+					if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+						t.Error(err)
+					}
+					current = pl["profile"]
+					got = append(got, current.StatusText)
+					fmt.Fprintln(w, `{"ok":true}`)
+				}
+			}))
+			defer ts.Close()
+
+			c := &Client{
+				workspaces:     []*workspace{{token: "token"}},
+				apiURL:         ts.URL,
+				httpClient:     ts.Client(),
+				emoji:          defaultEmoji,
+				checkPresence:  true,
+				checkDND:       true,
+				preserveManual: tt.preserveManual,
+				log:            mstatus.Logger(t.Log),
+			}
+			if err := c.SetStatus("playing", time.Time{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("got %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSlackStopDuringRun(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		fmt.Fprintln(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		workspaces: []*workspace{{token: "token"}, {token: "other"}},
+		apiURL:     ts.URL,
+		httpClient: ts.Client(),
+		log:        mstatus.Logger(t.Log),
+	}
+	ch := make(chan mstatus.Status)
+	done := make(chan struct{})
+	go func() {
+		c.Start(ch)
+		close(done)
+	}()
+
+	// A handler that times out is stopped while still running
+	go func() {
+		for i := 0; i < 5; i++ {
+			ch <- mstatus.Status{State: mstatus.StatePlaying, Track: &mstatus.Track{Title: fmt.Sprint(i)}}
+		}
+		close(ch)
+	}()
+	for i := 0; i < 5; i++ {
+		if err := c.Stop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestSlackRefresh(t *testing.T) {
+	var mu sync.Mutex
+	presence := "active"
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/" + presenceAction:
+			fmt.Fprintf(w, `{"ok":true,"presence":%q}`, presence)
+		case "/" + slackAction:
+			var pl map[string]payload
+			if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+				t.Error(err)
+			}
+			got = append(got, pl["profile"].StatusText)
+			fmt.Fprintln(w, `{"ok":true}`)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		workspaces:    []*workspace{{token: "token"}},
+		apiURL:        ts.URL,
+		httpClient:    ts.Client(),
+		emoji:         defaultEmoji,
+		checkPresence: true,
+		log:           mstatus.Logger(t.Log),
+	}
+	setPresence := func(p string) {
+		mu.Lock()
+		presence = p
+		mu.Unlock()
+	}
+
+	if err := c.SetStatus("playing", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// Unchanged while active
+	if err := c.RefreshStatus(); err != nil {
+		t.Fatal(err)
+	}
+	// Cleared once away, then published on return
+	setPresence("away")
+	for i := 0; i < 2; i++ {
+		if err := c.RefreshStatus(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setPresence("active")
+	if err := c.RefreshStatus(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing to publish after a reset
+	if err := c.ResetStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RefreshStatus(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"playing", "", "playing", ""}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("got %q, want %q", got, expected)
+	}
 }
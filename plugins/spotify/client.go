@@ -97,6 +97,7 @@ func (c *Client) Watch() error {
 
 	ticker := time.NewTicker(3 * time.Second)
 
+	// The API does not report the version of the player
 	status := mstatus.Status{
 		Player: mstatus.Player{Name: scope},
 	}
@@ -122,18 +123,36 @@ func (c *Client) Watch() error {
 				continue
 			}
 
+			item := cTrack.Item
+			var artists []string
+			for _, a := range item.Artists {
+				artists = append(artists, a.Name)
+			}
 			artist := ""
-			if len(cTrack.Item.Artists) > 0 {
-				artist = cTrack.Item.Artists[0].Name
+			if len(artists) > 0 {
+				artist = artists[0]
 			}
 
 			status.Track = &mstatus.Track{
-				ID:       cTrack.Item.ID.String(),
-				Title:    cTrack.Item.Name,
-				Artist:   artist,
-				Album:    cTrack.Item.Album.Name,
-				Duration: cTrack.Item.TimeDuration(),
-				//Elapsed:     elapsed,
+				ID:          item.ID.String(),
+				Title:       item.Name,
+				Artist:      artist,
+				Artists:     artists,
+				Album:       item.Album.Name,
+				TrackNumber: item.TrackNumber,
+				DiscNumber:  item.DiscNumber,
+				ReleaseDate: item.Album.ReleaseDate,
+				Duration:    item.TimeDuration(),
+				Elapsed:     time.Duration(cTrack.Progress) * time.Millisecond,
+				ISRC:        item.ExternalIDs["isrc"],
+				URI:         string(item.URI),
+			}
+			if len(item.Album.Artists) > 0 {
+				status.Track.AlbumArtist = item.Album.Artists[0].Name
+			}
+			// Images are ordered widest first
+			if len(item.Album.Images) > 0 {
+				status.Track.ArtworkURL = item.Album.Images[0].URL
 			}
 			status.State = mstatus.StatePlaying
 			c.events <- status
@@ -0,0 +1,310 @@
+package subsonic
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const (
+	scope = "subsonic"
+	// 1.13.0 introduced token authentication
+	apiVersion = "1.16.1"
+)
+
+// Client polls a Subsonic compatible server, such as Navidrome, for the
+// track the user is playing.
+type Client struct {
+	apiURL     string
+	username   string
+	password   string
+	interval   time.Duration
+	httpClient *http.Client
+
+	// The current play, the API only reports minutes since it started
+	currentID string
+	startedAt time.Time
+
+	events chan mstatus.Status
+	log    mstatus.Logger
+	done   chan struct{}
+}
+
+var _ mstatus.Source = (*Client)(nil)
+
+func init() {
+	mstatus.Register(&Client{
+		interval:   5 * time.Second,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan mstatus.Status),
+		log:        func(...interface{}) {},
+		done:       make(chan struct{}),
+	})
+}
+
+func (c *Client) Name() string {
+	return scope
+}
+
+func (c *Client) Load(sess *mstatus.Session, log mstatus.Logger) error {
+	c.log = log
+	if s := sess.ConfigString(scope, "url"); s != "" {
+		if !strings.HasPrefix(s, "http") {
+			s = "https://" + s
+		}
+		c.apiURL = s
+	}
+	if c.apiURL == "" {
+		return fmt.Errorf("missing subsonic url")
+	}
+	c.username = sess.ConfigString(scope, "username")
+	c.password = sess.ConfigString(scope, "password")
+	if c.username == "" || c.password == "" {
+		return fmt.Errorf("missing subsonic username or password")
+	}
+	if s := sess.ConfigString(scope, "interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("invalid subsonic interval %q", s)
+		}
+		c.interval = d
+	}
+	return nil
+}
+
+func (c *Client) Events() chan mstatus.Status {
+	return c.events
+}
+
+func (c *Client) Stop() error {
+	close(c.done)
+	return nil
+}
+
+func (c *Client) Watch() error {
+	c.log("subsonic starting")
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return nil
+
+		case <-ticker.C:
+			status := mstatus.Status{
+				State:  mstatus.StateStopped,
+				Player: mstatus.Player{Name: scope},
+			}
+			entry, err := c.nowPlaying()
+			if err != nil {
+				errorf("failed to get now playing: %s\n", err)
+				continue
+			}
+			if entry != nil {
+				status.State = mstatus.StatePlaying
+				status.Track = c.newTrack(entry, time.Now())
+				if entry.PlayerName != "" {
+					status.Player.Name = entry.PlayerName
+				}
+			}
+			c.events <- status
+		}
+	}
+}
+
+// entry is a song in the now playing list.
+type entry struct {
+	ID         string `json:"id"`
+	Title      string `json:"title"`
+	Album      string `json:"album"`
+	Artist     string `json:"artist"`
+	Track      int    `json:"track"`
+	DiscNumber int    `json:"discNumber"`
+	Year       int    `json:"year"`
+	Genre      string `json:"genre"`
+	Duration   int    `json:"duration"`
+	Path       string `json:"path"`
+	Username   string `json:"username"`
+	MinutesAgo int    `json:"minutesAgo"`
+	PlayerName string `json:"playerName"`
+	// OpenSubsonic extensions
+	MusicBrainzID      string   `json:"musicBrainzId"`
+	DisplayAlbumArtist string   `json:"displayAlbumArtist"`
+	Artists            []idName `json:"artists"`
+	Genres             []struct {
+		Name string `json:"name"`
+	} `json:"genres"`
+	ISRC []string `json:"isrc"`
+}
+
+type idName struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// APIError is an error response from the server.
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s", e.Code, e.Message)
+}
+
+// nowPlaying returns the user's most recent entry, if any.
+func (c *Client) nowPlaying() (*entry, error) {
+	var r struct {
+		NowPlaying struct {
+			Entry []entry `json:"entry"`
+		} `json:"nowPlaying"`
+	}
+	if err := c.call("getNowPlaying", &r); err != nil {
+		return nil, err
+	}
+	var out *entry
+	for i, e := range r.NowPlaying.Entry {
+		if !strings.EqualFold(e.Username, c.username) {
+			continue
+		}
+		if out == nil || e.MinutesAgo < out.MinutesAgo {
+			out = &r.NowPlaying.Entry[i]
+		}
+	}
+	return out, nil
+}
+
+// call performs a request, decoding the subsonic-response into out.
+func (c *Client) call(method string, out interface{}) error {
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	uri, err := url.JoinPath(c.apiURL, "rest", method)
+	if err != nil {
+		return err
+	}
+	q := url.Values{
+		"u": {c.username},
+		"t": {md5sum(c.password + salt)},
+		"s": {salt},
+		"v": {apiVersion},
+		"c": {mstatus.ClientName},
+		"f": {"json"},
+	}
+	resp, err := c.httpClient.Get(uri + "?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s failed: %d %q", method, resp.StatusCode, string(body))
+	}
+	var r struct {
+		Response json.RawMessage `json:"subsonic-response"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return err
+	}
+	var status struct {
+		Status string    `json:"status"`
+		Error  *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(r.Response, &status); err != nil {
+		return err
+	}
+	if status.Status != "ok" {
+		if status.Error != nil {
+			return fmt.Errorf("%s failed: %w", method, status.Error)
+		}
+		return fmt.Errorf("%s failed: %s", method, status.Status)
+	}
+	return json.Unmarshal(r.Response, out)
+}
+
+// newTrack maps an entry, estimating the elapsed time from when the play
+// was first seen.
+func (c *Client) newTrack(e *entry, now time.Time) *mstatus.Track {
+	// minutesAgo is truncated so only a later start is a new play of the
+	// same song
+	started := now.Add(-time.Duration(e.MinutesAgo) * time.Minute)
+	if e.ID != c.currentID || started.Sub(c.startedAt) >= time.Minute {
+		c.currentID = e.ID
+		c.startedAt = started
+	}
+	duration := time.Duration(e.Duration) * time.Second
+	elapsed := now.Sub(c.startedAt)
+	if duration > 0 && elapsed > duration {
+		elapsed = duration
+	}
+
+	out := &mstatus.Track{
+		ID:          e.ID,
+		Title:       e.Title,
+		Artist:      e.Artist,
+		Album:       e.Album,
+		AlbumArtist: e.DisplayAlbumArtist,
+		TrackNumber: e.Track,
+		DiscNumber:  e.DiscNumber,
+		Duration:    duration,
+		Elapsed:     elapsed,
+		MbTrackID:   e.MusicBrainzID,
+		URI:         e.Path,
+	}
+	if e.Year > 0 {
+		out.ReleaseDate = fmt.Sprint(e.Year)
+	}
+	for _, a := range e.Artists {
+		out.Artists = append(out.Artists, a.Name)
+	}
+	if len(out.Artists) == 0 && out.Artist != "" {
+		out.Artists = []string{out.Artist}
+	}
+	for _, g := range e.Genres {
+		out.Tags = append(out.Tags, g.Name)
+	}
+	if len(out.Tags) == 0 && e.Genre != "" {
+		out.Tags = []string{e.Genre}
+	}
+	if len(e.ISRC) > 0 {
+		out.ISRC = e.ISRC[0]
+	}
+	return out
+}
+
+func newSalt() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func md5sum(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func errorf(format string, v ...interface{}) {
+	fmt.Fprintf(os.Stderr, "subsonic error: "+format, v...)
+}
@@ -0,0 +1,133 @@
+package subsonic
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"src.userspace.com.au/felix/mstatus"
+)
+
+const nowPlayingResponse = `{"subsonic-response":{"status":"ok","version":"1.16.1","type":"navidrome","openSubsonic":true,"nowPlaying":{"entry":[
+{"id":"a1","title":"other","artist":"someone","username":"other","minutesAgo":0,"duration":100},
+{"id":"t1","title":"Motherless Children","album":"461 Ocean Boulevard","artist":"Eric Clapton","track":1,"discNumber":1,"year":1974,"genre":"Rock","duration":292,"path":"Eric Clapton/461 Ocean Boulevard/01.flac","username":"user","minutesAgo":2,"playerName":"Feishin","musicBrainzId":"10aae51f-f253-42c4-8af8-5673da1c98e6","displayAlbumArtist":"Eric Clapton","artists":[{"id":"ar1","name":"Eric Clapton"}],"genres":[{"name":"Rock"},{"name":"Blues"}],"isrc":["USRS17400001"]},
+{"id":"t0","title":"older","artist":"Eric Clapton","username":"user","minutesAgo":6,"duration":100}
+]}}}`
+
+func TestSubsonicNowPlaying(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/music/rest/getNowPlaying" {
+			t.Errorf("got path %q", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("v") != apiVersion || q.Get("f") != "json" || q.Get("c") == "" {
+			t.Errorf("got query %v", q)
+		}
+		if q.Get("u") != "user" || q.Get("s") == "" || q.Get("t") != md5sum("pass"+q.Get("s")) {
+			fmt.Fprint(w, `{"subsonic-response":{"status":"failed","version":"1.16.1","error":{"code":40,"message":"Wrong username or password"}}}`)
+			return
+		}
+		fmt.Fprint(w, nowPlayingResponse)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL + "/music",
+		username:   "user",
+		password:   "pass",
+		httpClient: ts.Client(),
+		log:        mstatus.Logger(t.Log),
+	}
+	e, err := c.nowPlaying()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.ID != "t1" {
+		t.Fatalf("got entry %v", e)
+	}
+
+	now := time.Now()
+	got := c.newTrack(e, now)
+	expected := &mstatus.Track{
+		ID:          "t1",
+		Title:       "Motherless Children",
+		Artist:      "Eric Clapton",
+		Artists:     []string{"Eric Clapton"},
+		Album:       "461 Ocean Boulevard",
+		AlbumArtist: "Eric Clapton",
+		TrackNumber: 1,
+		DiscNumber:  1,
+		ReleaseDate: "1974",
+		Tags:        []string{"Rock", "Blues"},
+		Duration:    292 * time.Second,
+		Elapsed:     2 * time.Minute,
+		MbTrackID:   "10aae51f-f253-42c4-8af8-5673da1c98e6",
+		ISRC:        "USRS17400001",
+		URI:         "Eric Clapton/461 Ocean Boulevard/01.flac",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#v, want %#v", got, expected)
+	}
+
+	// The estimate advances between polls
+	if got := c.newTrack(e, now.Add(30*time.Second)); got.Elapsed != 150*time.Second {
+		t.Errorf("got elapsed %s", got.Elapsed)
+	}
+	// and stops at the duration
+	e.MinutesAgo = 7
+	if got := c.newTrack(e, now.Add(5*time.Minute)); got.Elapsed != 292*time.Second {
+		t.Errorf("got elapsed %s", got.Elapsed)
+	}
+	// A replay of the same song starts again
+	e.MinutesAgo = 0
+	if got := c.newTrack(e, now.Add(5*time.Minute)); got.Elapsed != 0 {
+		t.Errorf("got elapsed %s", got.Elapsed)
+	}
+
+	c.password = "wrong"
+	_, err = c.nowPlaying()
+	if err == nil || err.Error() != "getNowPlaying failed: 40 Wrong username or password" {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSubsonicWatch(t *testing.T) {
+	var playing atomic.Bool
+	playing.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if playing.Load() {
+			fmt.Fprint(w, nowPlayingResponse)
+			return
+		}
+		fmt.Fprint(w, `{"subsonic-response":{"status":"ok","version":"1.16.1","nowPlaying":{}}}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{
+		apiURL:     ts.URL,
+		username:   "user",
+		password:   "pass",
+		interval:   10 * time.Millisecond,
+		httpClient: ts.Client(),
+		events:     make(chan mstatus.Status),
+		log:        mstatus.Logger(t.Log),
+		done:       make(chan struct{}),
+	}
+	go c.Watch()
+	defer c.Stop()
+
+	s := <-c.events
+	if s.State != mstatus.StatePlaying || s.Track == nil || s.Track.ID != "t1" || s.Player.Name != "Feishin" {
+		t.Errorf("got %#v", s)
+	}
+	playing.Store(false)
+	// One poll may have been made already
+	<-c.events
+	if s := <-c.events; s.State != mstatus.StateStopped || s.Track != nil {
+		t.Errorf("got %#v", s)
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"os"
 	"path"
 	"strings"
-	"sync/atomic"
+	"sync"
+	"time"
 )
 
 type Handler interface {
@@ -20,15 +21,34 @@ type Source interface {
 	Events() chan Status
 }
 
+// Enricher adds metadata to a track between the source and handlers. Enrich
+// is called for every status before it is delivered so it must not wait on
+// the network, slow lookups belong in the background.
+type Enricher interface {
+	Plugin
+	Enrich(*Track) error
+}
+
 type Server struct {
 	log           Logger
 	src           Source
 	handlers      []Handler
+	filters       map[string]*Filter
+	enrichers     []Enricher
+	artwork       *Artwork
 	stateFilePath string
-	stopping      atomic.Bool
 	sess          *Session
+
+	// quit ends delivery to handlers, closing their channels
+	quit     chan struct{}
+	running  sync.WaitGroup
+	stopOnce sync.Once
 }
 
+// handlerStopTimeout limits how long Stop waits for handlers to finish
+// with their final statuses, such as submitting a pending listen.
+const handlerStopTimeout = 10 * time.Second
+
 func New(opts ...Option) (*Server, error) {
 	cfgPath, err := os.UserConfigDir()
 	if err != nil {
@@ -63,6 +83,8 @@ func New(opts ...Option) (*Server, error) {
 		log:           func(...any) {},
 		sess:          sess,
 		stateFilePath: stateFilePath,
+		filters:       make(map[string]*Filter),
+		quit:          make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -76,8 +98,13 @@ func New(opts ...Option) (*Server, error) {
 		return nil, fmt.Errorf("source not defined")
 	}
 
-	src, ok := getPlugin(sourceName).(Source)
-	if src == nil || !ok {
+	var src Source
+	if sess.ConfigString(sourceName, "exec") != "" {
+		src = NewExecPlugin(sourceName, RoleSource)
+	} else if s, ok := getPlugin(sourceName).(Source); ok {
+		src = s
+	}
+	if src == nil {
 		return nil, fmt.Errorf("source plugin invalid")
 	}
 	out.log("loading source", src.Name())
@@ -86,10 +113,39 @@ func New(opts ...Option) (*Server, error) {
 	}
 	out.src = src
 
-	targetNames := strings.Split(sess.ConfigString("global", "targets"), ",")
+	if sess.ConfigBool("global", "artwork") {
+		dir := sess.ConfigString("global", "artworkDir")
+		if dir == "" {
+			if dir, err = CacheDir("artwork"); err != nil {
+				return nil, err
+			}
+		}
+		var fetchers []ArtworkFetcher
+		if f, ok := src.(ArtworkFetcher); ok {
+			fetchers = append(fetchers, f)
+		}
+		out.artwork = NewArtwork(dir, prefixedLogger("artwork", out.log), fetchers...)
+	}
+
+	enricherNames := splitNames(sess.ConfigString("global", "enrichers"))
+	for _, n := range enricherNames {
+		if n == "" {
+			continue
+		}
+		e, ok := getPlugin(n).(Enricher)
+		if e == nil || !ok {
+			return nil, fmt.Errorf("enricher %q invalid", n)
+		}
+		if err := e.Load(out.sess, prefixedLogger(e.Name(), out.log)); err != nil {
+			return nil, fmt.Errorf("failed to load enricher plugin %q: %w", n, err)
+		}
+		out.enrichers = append(out.enrichers, e)
+	}
+
+	targetNames := splitNames(sess.ConfigString("global", "targets"))
 
 	for _, n := range listPlugins() {
-		if strings.EqualFold(n, sourceName) {
+		if strings.EqualFold(n, sourceName) || contains(n, enricherNames) {
 			continue
 		}
 		if len(targetNames) == 0 || contains(n, targetNames) {
@@ -101,16 +157,79 @@ func New(opts ...Option) (*Server, error) {
 			if !ok {
 				return nil, fmt.Errorf("target %q invalid", n)
 			}
-			if err := h.Load(out.sess, prefixedLogger(h.Name(), out.log)); err != nil {
-				return nil, fmt.Errorf("failed to load target plugin %q", n)
+			if err := out.loadHandler(h); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// External programs configured with <name>.exec and further instances
+	// of plugins configured with <name>.plugin
+	for _, n := range targetNames {
+		if n == "" {
+			continue
+		}
+		if sess.ConfigString(n, "exec") != "" {
+			if err := out.loadHandler(NewExecPlugin(n, RoleHandler)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if pn := sess.ConfigString(n, "plugin"); pn != "" {
+			inst, ok := getPlugin(pn).(Instancer)
+			if !ok {
+				return nil, fmt.Errorf("plugin %q for target %q cannot have instances", pn, n)
+			}
+			h, ok := inst.NewInstance(n).(Handler)
+			if !ok {
+				return nil, fmt.Errorf("target %q invalid", n)
+			}
+			if err := out.loadHandler(h); err != nil {
+				return nil, err
 			}
-			out.handlers = append(out.handlers, tgt)
 		}
 	}
 
 	return out, nil
 }
 
+// CacheDir returns a directory for scope to cache data in, creating it if
+// required.
+func CacheDir(scope string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	dir = path.Join(dir, "music-status", scope)
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func (s *Server) loadHandler(h Handler) error {
+	log := prefixedLogger(h.Name(), s.log)
+	if err := h.Load(s.sess, log); err != nil {
+		return fmt.Errorf("failed to load target plugin %q: %w", h.Name(), err)
+	}
+	f, err := LoadFilter(s.sess, h.Name(), log)
+	if err != nil {
+		return err
+	}
+	s.filters[h.Name()] = f
+	s.handlers = append(s.handlers, h)
+	return nil
+}
+
+// splitNames splits a comma separated list of plugin names.
+func splitNames(s string) []string {
+	out := strings.Split(s, ",")
+	for i := range out {
+		out[i] = strings.TrimSpace(out[i])
+	}
+	return out
+}
+
 func contains(needle string, haystack []string) bool {
 	for _, s := range haystack {
 		if strings.EqualFold(s, needle) {
@@ -131,6 +250,13 @@ func WithHandler(h Handler) Option {
 	}
 }
 
+func WithEnricher(e Enricher) Option {
+	return func(s *Server) error {
+		s.enrichers = append(s.enrichers, e)
+		return nil
+	}
+}
+
 func WithLogger(l Logger) Option {
 	return func(s *Server) error {
 		s.log = l
@@ -143,19 +269,20 @@ func (s *Server) Start() error {
 	for _, h := range s.handlers {
 		ch := make(chan Status)
 		pub = append(pub, ch)
-		go h.Start(ch)
+		s.running.Add(1)
+		go func(h Handler) {
+			defer s.running.Done()
+			h.Start(ch)
+		}(h)
 	}
 
 	go func() {
-		var lastState State
-		for event := range s.src.Events() {
-			if event.State != lastState {
-				s.log("server event:", event.State)
-				lastState = event.State
-			}
-			for _, ch := range pub {
-				ch <- event
-			}
+		s.publish(pub)
+		for _, ch := range pub {
+			close(ch)
+		}
+		// The source may send until it notices it is stopped
+		for range s.src.Events() {
 		}
 	}()
 
@@ -163,20 +290,85 @@ func (s *Server) Start() error {
 	return s.src.Watch()
 }
 
-func (s *Server) Stop() error {
-	if s.stopping.Load() {
-		return nil
+// publish sends source events to the handlers until Stop is called.
+func (s *Server) publish(pub []chan Status) {
+	var lastState State
+	for {
+		var event Status
+		select {
+		case <-s.quit:
+			return
+		case event = <-s.src.Events():
+		}
+		if event.State != lastState {
+			s.log("server event:", event.State)
+			lastState = event.State
+		}
+		event = s.enrich(event)
+		for i, ch := range pub {
+			ch <- s.filters[s.handlers[i].Name()].Apply(event)
+		}
+	}
+}
+
+// enrich runs the enrichers over a copy of the event's track and resolves
+// its artwork.
+func (s *Server) enrich(event Status) Status {
+	if event.Track == nil || (len(s.enrichers) == 0 && s.artwork == nil) {
+		return event
+	}
+	t := *event.Track
+	for _, e := range s.enrichers {
+		if err := e.Enrich(&t); err != nil {
+			s.log("failed to enrich", e.Name(), err)
+		}
 	}
-	s.stopping.Store(true)
+	if s.artwork != nil {
+		t.ArtworkPath = s.artwork.Path(&t)
+	}
+	event.Track = &t
+	return event
+}
+
+// Stop stops the source then closes the handlers' channels so they can
+// finish, for example by submitting the listen in progress. Concurrent
+// calls wait for the first to complete.
+func (s *Server) Stop() error {
+	s.stopOnce.Do(s.stop)
+	return nil
+}
+
+func (s *Server) stop() {
 	s.log("service stopping")
+	if err := s.src.Stop(); err != nil {
+		s.log("failed to stop source", s.src.Name(), err)
+	}
+
+	close(s.quit)
+	finished := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(handlerStopTimeout):
+		s.log("timed out waiting for handlers")
+	}
+
 	for _, h := range s.handlers {
 		s.log("stopping plugin", h.Name())
 		if err := h.Stop(); err != nil {
 			s.log("failed to stop plugin", h.Name(), err)
 		}
 	}
-	if err := s.src.Stop(); err != nil {
-		s.log("failed to stop source", s.src.Name(), err)
+	for _, e := range s.enrichers {
+		if err := e.Stop(); err != nil {
+			s.log("failed to stop enricher", e.Name(), err)
+		}
+	}
+	if s.artwork != nil {
+		s.artwork.Stop()
 	}
 
 	// Write out state file
@@ -193,5 +385,4 @@ func (s *Server) Stop() error {
 	if err := enc.Encode(s.sess.state); err != nil {
 		s.log("failed to encode state file", err)
 	}
-	return nil
 }
@@ -0,0 +1,83 @@
+package mstatus
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSource sends statuses until it is stopped.
+type testSource struct {
+	events chan Status
+	done   chan struct{}
+}
+
+func (s *testSource) Name() string                { return "test" }
+func (s *testSource) Load(*Session, Logger) error { return nil }
+func (s *testSource) Events() chan Status         { return s.events }
+func (s *testSource) Watch() error                { <-s.done; return nil }
+func (s *testSource) Stop() error                 { close(s.done); return nil }
+
+// testScrobbler records completed listens.
+type testScrobbler struct {
+	listens chan Listen
+	stopped bool
+}
+
+func (h *testScrobbler) Name() string                { return "scrobbler" }
+func (h *testScrobbler) Load(*Session, Logger) error { return nil }
+func (h *testScrobbler) Stop() error                 { h.stopped = true; return nil }
+func (h *testScrobbler) Start(events <-chan Status) {
+	for l := range NewListenTracker(ListenRule{}).Run(events) {
+		if l.Type == ListenCompleted {
+			h.listens <- l
+		}
+	}
+	close(h.listens)
+}
+
+func TestServerStopFlushes(t *testing.T) {
+	sess, err := readConfig(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &testSource{events: make(chan Status), done: make(chan struct{})}
+	h := &testScrobbler{listens: make(chan Listen, 1)}
+	s := &Server{
+		log:           Logger(t.Log),
+		src:           src,
+		handlers:      []Handler{h},
+		filters:       map[string]*Filter{},
+		stateFilePath: filepath.Join(t.TempDir(), "state"),
+		sess:          sess,
+		quit:          make(chan struct{}),
+	}
+	started := make(chan error)
+	go func() { started <- s.Start() }()
+
+	track := Track{ID: "1", Title: "title"}
+	src.events <- Status{State: StatePlaying, Track: &track}
+	time.Sleep(10 * time.Millisecond)
+	listened := track
+	listened.Elapsed = 10 * time.Millisecond
+	src.events <- Status{State: StatePlaying, Track: &listened}
+
+	// Concurrent calls wait for the first
+	go s.Stop()
+	s.Stop()
+	if err := <-started; err != nil {
+		t.Fatal(err)
+	}
+	if !h.stopped {
+		t.Error("handler not stopped")
+	}
+	select {
+	case l, ok := <-h.listens:
+		if !ok || l.Track.ID != "1" {
+			t.Errorf("got %v", l)
+		}
+	default:
+		t.Error("listen in progress was not flushed")
+	}
+}
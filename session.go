@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -21,6 +22,9 @@ func readConfig(f io.Reader) (*Session, error) {
 	r := csv.NewReader(f)
 	r.Comma = '='
 	r.Comment = '#'
+	// Values may contain '=' and quotes, such as in templates
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
 
 	out := &Session{
 		data:  make(map[string]string),
@@ -35,7 +39,10 @@ func readConfig(f io.Reader) (*Session, error) {
 	}
 
 	for _, row := range data {
-		out.data[row[0]] = row[1]
+		if len(row) < 2 {
+			return nil, fmt.Errorf("missing value for %q", row[0])
+		}
+		out.data[row[0]] = strings.Join(row[1:], "=")
 	}
 	return out, nil
 }
@@ -50,6 +57,19 @@ func (s *Session) ConfigString(scope, key string) string {
 	return ""
 }
 
+// ConfigScope returns all keys set for scope, without the scope prefix.
+func (s *Session) ConfigScope(scope string) map[string]string {
+	s.Lock()
+	defer s.Unlock()
+	out := make(map[string]string)
+	for k, v := range s.data {
+		if key, ok := strings.CutPrefix(k, scope+"."); ok {
+			out[key] = v
+		}
+	}
+	return out
+}
+
 func (s *Session) ConfigInt(scope, key string) int {
 	var out int
 	if s := s.ConfigString(scope, key); s != "" {
@@ -58,6 +78,14 @@ func (s *Session) ConfigInt(scope, key string) int {
 	return out
 }
 
+func (s *Session) ConfigBool(scope, key string) bool {
+	var out bool
+	if s := s.ConfigString(scope, key); s != "" {
+		out, _ = strconv.ParseBool(s)
+	}
+	return out
+}
+
 func (s *Session) WriteState(scope string, v any) error {
 	s.Lock()
 	defer s.Unlock()
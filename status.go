@@ -2,6 +2,8 @@ package mstatus
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -22,19 +24,47 @@ type Track struct {
 	ID          string
 	Title       string
 	Artist      string
+	Artists     []string // all credited artists
 	Album       string
+	AlbumArtist string
+	TrackNumber int
+	DiscNumber  int
+	ReleaseDate string   // as provided, YYYY or YYYY-MM-DD
+	Tags        []string // genres or tags
 	Duration    time.Duration
 	Elapsed     time.Duration
 	MbArtistID  string
 	MbTrackID   string // recording ID
 	MbReleaseID string // album ID
+	// release track ID, unique to the track on a particular release
+	MbReleaseTrackID string
+	MbReleaseGroupID string
+	MbWorkID         string
+	ISRC             string
+	ArtworkURL       string
+	ArtworkPath      string // local copy of the cover art, if enabled
+	URI              string // source location, file path or URL
+	// Redacted tracks have had their details replaced by a filter and are
+	// not real listens
+	Redacted bool
 }
 
 func (s Track) String() string {
+	if s.Artist == "" {
+		return fmt.Sprintf("%q", s.Title)
+	}
 	return fmt.Sprintf("%q by %s", s.Title, s.Artist)
 
 }
 
+// ParseNumber parses a track or disc number in the form "1" or "1/12",
+// returning 0 if it is not a number.
+func ParseNumber(s string) int {
+	s, _, _ = strings.Cut(s, "/")
+	i, _ := strconv.Atoi(strings.TrimSpace(s))
+	return i
+}
+
 type Status struct {
 	State  State
 	Player Player
@@ -43,8 +73,8 @@ type Status struct {
 }
 
 type Player struct {
-	Name    string
-	Version string
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
 }
 
 type Logger func(...any)
@@ -0,0 +1,19 @@
+package mstatus
+
+import "testing"
+
+func TestParseNumber(t *testing.T) {
+	tests := map[string]int{
+		"":      0,
+		"1":     1,
+		" 2 ":   2,
+		"3/12":  3,
+		"04/12": 4,
+		"A1":    0,
+	}
+	for in, expected := range tests {
+		if got := ParseNumber(in); got != expected {
+			t.Errorf("ParseNumber(%q) = %d, want %d", in, got, expected)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mstatus
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TemplateData is passed to user supplied templates. Track is always set so
+// templates need not check for nil.
+type TemplateData struct {
+	State  State
+	Player Player
+	Track  Track
+}
+
+// NewTemplateData returns the template data for s.
+func NewTemplateData(s Status) TemplateData {
+	out := TemplateData{State: s.State, Player: s.Player}
+	if s.Track != nil {
+		out.Track = *s.Track
+	}
+	return out
+}
+
+var templateFuncs = template.FuncMap{
+	"join": func(sep string, v []string) string {
+		return strings.Join(v, sep)
+	},
+	// minutes formats a duration as m:ss
+	"minutes": func(d time.Duration) string {
+		d = d.Round(time.Second)
+		return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+	},
+}
+
+// NewTemplate parses a user supplied template, adding the join and minutes
+// functions.
+func NewTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// ExecuteTemplate renders t with the data for s.
+func ExecuteTemplate(t *template.Template, s Status) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, NewTemplateData(s)); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,45 @@
+package mstatus
+
+import (
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+const (
+	// ClientName identifies this program to services
+	ClientName = "music-status"
+	// ClientURL is the project home
+	ClientURL = "https://github.com/felix/music-status"
+)
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+func readVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "devel"
+	}
+	v := info.Main.Version
+	if v == "" || v == "(devel)" {
+		// Fall back to the commit for local builds
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+				return "devel-" + s.Value[:7]
+			}
+		}
+		return "devel"
+	}
+	return strings.TrimPrefix(v, "v")
+}
+
+// Version returns the version of the main module from the build info.
+func Version() string {
+	versionOnce.Do(func() {
+		version = readVersion()
+	})
+	return version
+}